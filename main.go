@@ -1,51 +1,217 @@
 package main
 
 import (
-	"./proxy"
 	"./dashboard"
-	"fmt"
+	"./proxy"
+	"errors"
+	"flag"
+	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	configFile    = flag.String("config", "", "path of config file")
+	listen        = flag.String("listen", "", "address the proxy listen on")
+	seeds         = flag.String("seeds", "", "comma separated cluster nodes, tried in turn")
+	poolSize      = flag.Int("pool-size", 0, "number of connections to each node")
+	dialTimeout   = flag.Int("dial-timeout", 0, "dial timeout in millisecond")
+	readTimeout   = flag.Int("read-timeout", 0, "read timeout in millisecond")
+	writeTimeout  = flag.Int("write-timeout", 0, "write timeout in millisecond")
+	drainTimeout  = flag.Int("drain-timeout", 0, "how long shutdown waits for in-flight requests in millisecond")
+	readPolicy    = flag.String("read-policy", "", "read policy: master, prefer-replica, round-robin or lowest-latency")
+	allowFlushAll = flag.Bool("allow-flushall", false, "allow FLUSHALL and FLUSHDB on all masters")
+	metricsAddr   = flag.String("metrics", "", "address of prometheus /metrics endpoint, disabled if empty")
+	dashboardAddr = flag.String("dashboard", "", "address of dashboard, disabled if empty")
 )
 
 func main() {
 	runtime.GOMAXPROCS(4)
+	flag.Parse()
 
-	//proxyAddr := "127.0.0.1:7101"
-	//startProxy(proxyAddr)
+	conf, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	dashboardAddr := "127.0.0.1:7102"
-	startDashboard(dashboardAddr)
+	if conf.Dashboard != "" {
+		go startDashboard(conf.Dashboard)
+	}
+	startProxy(conf)
 }
 
-func startProxy(addr string) {
-	server := proxy.NewProxy(addr)
+// loadConfig load config file if given, options set on command line override the file
+func loadConfig() (*proxy.Config, error) {
+	conf := proxy.DefaultConfig()
+	if *configFile != "" {
+		var err error
+		if conf, err = proxy.LoadConfig(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			conf.Listen = *listen
+		case "seeds":
+			conf.Seeds = strings.Split(*seeds, ",")
+		case "pool-size":
+			conf.PoolSize = *poolSize
+		case "dial-timeout":
+			conf.DialTimeout = *dialTimeout
+		case "read-timeout":
+			conf.ReadTimeout = *readTimeout
+		case "write-timeout":
+			conf.WriteTimeout = *writeTimeout
+		case "drain-timeout":
+			conf.DrainTimeout = *drainTimeout
+		case "read-policy":
+			conf.ReadPolicy = *readPolicy
+		case "allow-flushall":
+			conf.AllowFlushAll = *allowFlushAll
+		case "metrics":
+			conf.Metrics = *metricsAddr
+		case "dashboard":
+			conf.Dashboard = *dashboardAddr
+		}
+	})
+	return conf, conf.Check()
+}
 
-	ln, err := net.Listen("tcp", ":7011")
+func startProxy(conf *proxy.Config) {
+	server, err := proxy.NewProxy(conf)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.Fatal(err)
 	}
 
-	ch := make(chan net.Conn, 10)
-	go func() {
-		for conn := range ch {
-			go func(conn net.Conn) {
-				proxy.NewSession(conn).Loop(server)
-			}(conn)
+	// the metrics listener is inherited on hot restart too, the parent holds the port
+	var metricsLn net.Listener
+	if conf.Metrics != "" {
+		if metricsLn, err = proxy.ListenMetrics(conf.Metrics); err != nil {
+			log.Println("metrics server stopped,", err)
+		} else {
+			log.Println("metrics listen on", conf.Metrics)
+			go startMetrics(metricsLn, server)
 		}
+	}
+
+	ln, err := proxy.Listen(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.TLS.Enabled {
+		log.Println("proxy listen on", conf.Listen, "with TLS")
+	} else {
+		log.Println("proxy listen on", conf.Listen)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2, syscall.SIGHUP)
+	go serve(ln, server)
+	// the parent drains once this process is serving on the inherited listener
+	if err := proxy.TakeOver(); err != nil {
+		log.Println("notify parent process failed,", err)
+	}
+
+	sig := waitSignal(sigs, ln, metricsLn, func() {
+		newConf, err := loadConfig()
+		if err == nil {
+			err = server.Reload(newConf)
+		}
+		if err != nil {
+			log.Println("reload config failed, keep the old one.", err)
+			return
+		}
+		conf = newConf
+	})
+	log.Println("received", sig, ", stop accepting and drain sessions")
+	// a second signal stops the proxy without waiting
+	go func() {
+		<-sigs
+		log.Fatal("received another signal, exit now")
 	}()
+	ln.Close()
+	proxy.DrainSessions(time.Duration(conf.DrainTimeout) * time.Millisecond)
+	server.Close()
+	log.Println("proxy stopped")
+}
+
+// waitSignal handle SIGHUP by calling reload and SIGUSR2 by starting a new process
+// on the same listeners, until SIGTERM or SIGINT is received. The new process sends
+// SIGTERM once it's serving
+func waitSignal(sigs chan os.Signal, ln net.Listener, metricsLn net.Listener, reload func()) os.Signal {
+	exited := make(chan *os.ProcessState, 1)
+	restarting := false
+	for {
+		select {
+		case state := <-exited:
+			log.Println("new process", state.Pid(), "exited before taking over,", state)
+			restarting = false
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				log.Println("received", sig, ", reload config")
+				reload()
+				continue
+			}
+			if sig != syscall.SIGUSR2 {
+				return sig
+			}
+			if restarting {
+				log.Println("restart in progress, ignore", sig)
+				continue
+			}
+			proc, err := proxy.Restart(ln, metricsLn)
+			if err != nil {
+				log.Println("restart failed,", err)
+				continue
+			}
+			log.Println("started new process", proc.Pid, ", drain once it's serving")
+			restarting = true
+			go func() {
+				state, err := proc.Wait()
+				if err != nil {
+					log.Println("wait new process failed,", err)
+					return
+				}
+				exited <- state
+			}()
+		}
+	}
+}
 
+// serve accept clients until the listener is closed
+func serve(ln net.Listener, server proxy.Proxy) {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			fmt.Println("accept error", err.Error())
-		} else {
-			ch <- conn
+			log.Println("accept error", err.Error())
+			continue
 		}
+		go proxy.NewSession(conn).Loop(server)
+	}
+}
+
+func startMetrics(ln net.Listener, server proxy.Proxy) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		server.WriteMetrics(w)
+	})
+	if err := http.Serve(ln, mux); err != nil {
+		log.Println("metrics server stopped,", err)
 	}
 }
 
 func startDashboard(addr string) {
 	dashboard := dashboard.NewDashboard(addr)
 	dashboard.Start()
-}
\ No newline at end of file
+}
@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"strings"
+)
+
+// DEFAULTUSER is the user authenticated by `AUTH password`
+const DEFAULTUSER = "default"
+
+// UserConfig is a user of clients, commands are rules like redis ACL evaluated in
+// order, the last matched one wins: +cmd, -cmd, +@category and -@category.
+// Keys are glob patterns of keys the user may access
+type UserConfig struct {
+	Name     string   `toml:"name"`
+	Password string   `toml:"password"`
+	Commands []string `toml:"commands"`
+	Keys     []string `toml:"keys"`
+}
+
+// command categories of ACL rules
+var aclCategories = map[string]func(*commandInfo) bool{
+	"all":         func(c *commandInfo) bool { return true },
+	"read":        func(c *commandInfo) bool { return c.flags&CmdReadonly != 0 },
+	"write":       func(c *commandInfo) bool { return c.flags&CmdWrite != 0 },
+	"admin":       func(c *commandInfo) bool { return c.flags&CmdAdmin != 0 },
+	"blocking":    func(c *commandInfo) bool { return c.flags&CmdBlocking != 0 },
+	"pubsub":      func(c *commandInfo) bool { return c.flags&CmdPubsub != 0 },
+	"scripting":   func(c *commandInfo) bool { return scriptingCmds[c.name] },
+	"transaction": func(c *commandInfo) bool { return txCmds[c.name] },
+	"keyspace":    func(c *commandInfo) bool { return keyspaceCmds[c.name] },
+}
+
+var scriptingCmds = map[string]bool{
+	"EVAL":       true,
+	"EVALSHA":    true,
+	"EVAL_RO":    true,
+	"EVALSHA_RO": true,
+	"SCRIPT":     true,
+	"FCALL":      true,
+	"FCALL_RO":   true,
+	"FUNCTION":   true,
+}
+
+// keyspaceCmds access keys not given in arguments, they are denied to users
+// restricted to key patterns
+var keyspaceCmds = map[string]bool{
+	"KEYS":      true,
+	"SCAN":      true,
+	"RANDOMKEY": true,
+	"FLUSHALL":  true,
+	"FLUSHDB":   true,
+}
+
+// aclRule allows or denies a command or a category of commands
+type aclRule struct {
+	allow    bool
+	command  string
+	category string
+}
+
+// aclUser is a user compiled from config
+type aclUser struct {
+	name     string
+	password string
+	// nil allows all commands
+	rules []aclRule
+	// nil allows all keys
+	keys []string
+}
+
+// acl holds users of clients, clients must authenticate if it's not empty
+type acl struct {
+	users map[string]*aclUser
+}
+
+// newACL compile users of conf, conf.Password is the password of default user
+func newACL(conf *Config) (*acl, error) {
+	a := &acl{users: make(map[string]*aclUser)}
+	if conf.Password != "" {
+		a.users[DEFAULTUSER] = &aclUser{name: DEFAULTUSER, password: conf.Password}
+	}
+	for _, uc := range conf.Users {
+		switch {
+		case uc.Name == "":
+			return nil, protocolError("config: user without name")
+		case uc.Password == "":
+			return nil, protocolError("config: user " + uc.Name + " has no password")
+		case a.users[uc.Name] != nil:
+			return nil, protocolError("config: user " + uc.Name + " defined twice")
+		}
+		user := &aclUser{name: uc.Name, password: uc.Password}
+		if len(uc.Commands) > 0 {
+			user.rules = make([]aclRule, 0, len(uc.Commands))
+			for _, s := range uc.Commands {
+				rule, err := parseACLRule(s)
+				if err != nil {
+					return nil, protocolError("config: user " + uc.Name + ": " + err.Error())
+				}
+				user.rules = append(user.rules, rule)
+			}
+		}
+		for _, pattern := range uc.Keys {
+			if pattern == "*" {
+				user.keys = nil
+				break
+			}
+			user.keys = append(user.keys, pattern)
+		}
+		a.users[uc.Name] = user
+	}
+	return a, nil
+}
+
+func parseACLRule(s string) (aclRule, error) {
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return aclRule{}, protocolError("bad command rule " + s)
+	}
+	rule := aclRule{allow: s[0] == '+'}
+	if s[1] == '@' {
+		rule.category = strings.ToLower(s[2:])
+		if aclCategories[rule.category] == nil {
+			return aclRule{}, protocolError("unknown command category " + s)
+		}
+		return rule, nil
+	}
+	rule.command = strings.ToUpper(s[1:])
+	if lookupCommand(rule.command) == nil {
+		return aclRule{}, protocolError("unknown command " + s)
+	}
+	return rule, nil
+}
+
+// required tell if clients must authenticate
+func (a *acl) required() bool {
+	return len(a.users) > 0
+}
+
+// authenticate return nil if the username-password pair is wrong
+func (a *acl) authenticate(name, password string) *aclUser {
+	user := a.users[name]
+	if user == nil || subtle.ConstantTimeCompare([]byte(user.password), []byte(password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// check return NOPERM error if the user may not run the command with args and keys
+func (u *aclUser) check(c *commandInfo, args [][]byte, keys [][]byte) error {
+	if !u.allowCommand(c) {
+		return redisError("NOPERM User " + u.name + " has no permissions to run the '" + strings.ToLower(c.name) + "' command")
+	}
+	if u.keys == nil {
+		return nil
+	}
+	// scripts may access keys not declared, as SORT does by patterns
+	if keyspaceCmds[c.name] || scriptingCmds[c.name] || sortPatterns(c, args) {
+		return redisError("NOPERM No permissions to access a key")
+	}
+	// channels of shard pub/sub are not keys
+	if c.flags&CmdPubsub != 0 {
+		return nil
+	}
+	for _, key := range keys {
+		if !u.allowKey(string(key)) {
+			return redisError("NOPERM No permissions to access a key")
+		}
+	}
+	return nil
+}
+
+// sortPatterns tell if SORT reads keys by BY or GET patterns, a pattern without
+// `*` reads no key
+func sortPatterns(c *commandInfo, args [][]byte) bool {
+	if c.name != "SORT" && c.name != "SORT_RO" {
+		return false
+	}
+	for i := 1; i+1 < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BY", "GET":
+			if strings.Contains(string(args[i+1]), "*") {
+				return true
+			}
+			i++
+		case "LIMIT":
+			i += 2
+		}
+	}
+	return false
+}
+
+func (u *aclUser) allowCommand(c *commandInfo) bool {
+	if u.rules == nil {
+		return true
+	}
+	for i := len(u.rules) - 1; i >= 0; i-- {
+		rule := u.rules[i]
+		if rule.command == c.name || (rule.category != "" && aclCategories[rule.category](c)) {
+			return rule.allow
+		}
+	}
+	return false
+}
+
+func (u *aclUser) allowKey(key string) bool {
+	for _, pattern := range u.keys {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch match s against pattern like redis KEYS: *, ?, [abc], [^a], [a-z] and \x
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := classEnd(pattern[1:])
+			if end < 0 {
+				// unterminated class is matched literally
+				if s[0] != '[' {
+					return false
+				}
+				s = s[1:]
+				pattern = pattern[1:]
+				continue
+			}
+			class := pattern[1 : end+1]
+			pattern = pattern[end+2:]
+			if !matchClass(class, s[0]) {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// classEnd return the index of `]` closing a character class, escaped ones are
+// part of the class, -1 if it's unterminated
+func classEnd(class string) int {
+	for i := 0; i < len(class); i++ {
+		switch class[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// matchClass match c against a character class without brackets
+func matchClass(class string, c byte) bool {
+	not := len(class) > 0 && class[0] == '^'
+	if not {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			matched = matched || class[i] == c
+		case i+2 < len(class) && class[i+1] == '-':
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			i += 2
+		default:
+			matched = matched || class[i] == c
+		}
+	}
+	return matched != not
+}
+
+// authDo handle AUTH [username] password
+func (sess *session) authDo(proxy Proxy, args [][]byte) ([]byte, error) {
+	a := proxy.getACL()
+	name, password := DEFAULTUSER, string(args[0])
+	switch len(args) {
+	case 1:
+		if !a.required() {
+			return nil, redisError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	case 2:
+		name, password = string(args[0]), string(args[1])
+	default:
+		return nil, redisError("ERR syntax error")
+	}
+	user := a.authenticate(name, password)
+	if user == nil {
+		return nil, redisError("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	sess.user.Store(user)
+	return encodeReply(okReply), nil
+}
+
+// checkAccess return NOAUTH error if the session must authenticate, or NOPERM
+// error if its user may not run req
+func (sess *session) checkAccess(proxy Proxy, req *request) error {
+	// HELLO may authenticate by itself
+	if req.cmd == nil || req.name == "AUTH" || req.name == "HELLO" {
+		return nil
+	}
+	a := proxy.getACL()
+	user, _ := sess.user.Load().(*aclUser)
+	// rules of the user may be changed by reloading config, or the user is removed
+	if user != nil {
+		user = a.users[user.name]
+	}
+	if user == nil {
+		if a.required() {
+			return redisError("NOAUTH Authentication required.")
+		}
+		return nil
+	}
+	return user.check(req.cmd, req.args, req.keys)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"app:*", "app:1", true},
+		{"app:*", "app:", true},
+		{"app:*", "ap", false},
+		{"app:*", "other:1", false},
+		{"*:id", "user:id", true},
+		{"*:id", "user:idx", false},
+		{"a**b", "axxb", true},
+		{"a*b*c", "abbbc", true},
+		{"a*b*c", "acb", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[ello", "h[ello", true},
+		{"h[ello", "hello", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"trailing\\", "trailing\\", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.s); got != test.match {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.s, got, test.match)
+		}
+	}
+}
+
+func TestACLCheckKeys(t *testing.T) {
+	user := &aclUser{name: "app", keys: []string{"app:*"}}
+	tests := []struct {
+		cmd   string
+		allow bool
+	}{
+		{"GET app:1", true},
+		{"GET other", false},
+		{"MSET app:1 v app:2 v", true},
+		{"MSET app:1 v other v", false},
+		{"KEYS *", false},
+		{"EVAL return 1 1 app:1", false},
+		{"EVALSHA abc 0", false},
+		{"FCALL f 1 app:1", false},
+		{"SORT app:list", true},
+		{"SORT app:list BY nosort", true},
+		{"SORT app:list LIMIT 0 10 GET #", true},
+		{"SORT app:list BY other:*", false},
+		{"SORT app:list get other:*->field", false},
+		{"SORT_RO app:list GET other:*", false},
+		{"SORT app:list STORE other", false},
+	}
+	for _, test := range tests {
+		fields := strings.Fields(test.cmd)
+		c := lookupCommand(fields[0])
+		args := make([][]byte, 0, len(fields)-1)
+		for _, f := range fields[1:] {
+			args = append(args, []byte(f))
+		}
+		err := user.check(c, args, c.keys(args))
+		if (err == nil) != test.allow {
+			t.Errorf("%s: got %v, want allowed %v", test.cmd, err, test.allow)
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var askingCmd = []byte("*1\r\n$6\r\nASKING\r\n")
+
+// errPingBusy is returned by ping if the queue of the connection is full, the
+// connection is busy rather than broken
+var errPingBusy = protocolError("ping not queued, connection is busy")
+
+// helloCmds switch the protocol of a dedicated connection
+var helloCmds = map[int][]byte{
+	RESP2: []byte("*2\r\n$5\r\nHELLO\r\n$1\r\n2\r\n"),
+	RESP3: []byte("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"),
+}
+
+// backoff of reconnecting to an unreachable node
+const (
+	RECONNECTMIN = 100 * time.Millisecond
+	RECONNECTMAX = 10 * time.Second
+)
+
+// backend holds a few pipelined connections to one node, requests from all
+// sessions are multiplexed onto them. Connections of a backend speak one protocol,
+// requests of RESP3 sessions go through another backend of the node
+type backend struct {
+	addr  string
+	proto int
+	dial  func(string, int) (RedisConn, error)
+	// nil if the connection is not established
+	conns []*pipeConn
+	// hold read lock while sending to a connection, write lock while replacing one
+	lock sync.RWMutex
+	// held by check and reset, so connections are not replaced while pinged
+	checkLock sync.Mutex
+	// a routine is reconnecting missing connections
+	reconnecting bool
+	closed       bool
+	// moving average of ping latency in nanosecond
+	latency int64
+	// error of the last failed dial, cleared once a connection is dialed
+	dialErr error
+	// connections are dialed for the first time
+	initialized bool
+	// counters for metrics
+	requests   uint64
+	errors     uint64
+	reconnects uint64
+	poolWait   *histogram
+	// connections to the node speaking RESP3, dialed on the first request of
+	// a RESP3 session
+	resp3     *backend
+	resp3Lock sync.Mutex
+}
+
+// backendReq is a request waiting for reply from a pipeConn
+type backendReq struct {
+	cmd []byte
+	ask bool
+	// when the request is queued
+	queued time.Time
+	resp   []byte
+	err    error
+	done   chan struct{}
+	// long bulk string replies are streamed through it if it's set
+	stream *replyStream
+}
+
+// pipeConn writes requests in batches, one flush for all requests queued,
+// and replies are read back and handed to callers in FIFO order
+type pipeConn struct {
+	conn RedisConn
+	// requests to be written
+	reqs chan *backendReq
+	// requests written, waiting for reply
+	inflight chan *backendReq
+	err      error
+	errLock  sync.Mutex
+	// time requests wait to be written
+	wait *histogram
+	// called in background once the connection is broken
+	broken func(*pipeConn)
+	// reqs is closed once by close or drain
+	closeOnce sync.Once
+}
+
+// newBackend dial size connections to addr speaking proto
+func newBackend(addr string, size int, proto int, dial func(string, int) (RedisConn, error)) *backend {
+	b := &backend{
+		addr:     addr,
+		proto:    proto,
+		dial:     dial,
+		conns:    make([]*pipeConn, size),
+		poolWait: newHistogram(),
+	}
+	missing := b.redial()
+	b.lock.Lock()
+	b.initialized = true
+	b.lock.Unlock()
+	if missing > 0 {
+		b.startReconnect()
+	}
+	return b
+}
+
+// redial dial missing connections, return the number of connections still missing
+func (b *backend) redial() int {
+	missing := 0
+	// connections may be replaced by reset meanwhile
+	for i := 0; i < b.size(); i++ {
+		b.lock.RLock()
+		pc := b.conn(i)
+		b.lock.RUnlock()
+		if pc != nil {
+			continue
+		}
+
+		pc, err := b.dialPipeConn()
+		if err != nil {
+			// the node is likely unreachable, don't wait for other dials to time out
+			log.Println("failed to dail node", b.addr, err.Error())
+			b.lock.Lock()
+			b.dialErr = err
+			for _, pc := range b.conns[i:] {
+				if pc == nil {
+					missing++
+				}
+			}
+			b.lock.Unlock()
+			return missing
+		}
+		b.lock.Lock()
+		if b.closed {
+			b.lock.Unlock()
+			pc.close()
+			return 0
+		}
+		if i >= len(b.conns) || b.conns[i] != nil {
+			// dialed by another routine, or the pool shrinks
+			b.lock.Unlock()
+			pc.close()
+			continue
+		}
+		b.conns[i] = pc
+		b.dialErr = nil
+		if b.initialized {
+			atomic.AddUint64(&b.reconnects, 1)
+		}
+		b.lock.Unlock()
+	}
+	return missing
+}
+
+// startReconnect mark the node unhealthy and reconnect with backoff in background
+func (b *backend) startReconnect() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.reconnecting || b.closed {
+		return
+	}
+	b.reconnecting = true
+	log.Println("node", b.addr, "is unhealthy, reconnecting in background")
+
+	go func() {
+		delay := RECONNECTMIN
+		for {
+			time.Sleep(delay)
+			if b.redial() == 0 {
+				break
+			}
+			if delay *= 2; delay > RECONNECTMAX {
+				delay = RECONNECTMAX
+			}
+		}
+		b.lock.Lock()
+		b.reconnecting = false
+		b.lock.Unlock()
+		log.Println("node", b.addr, "is healthy again")
+	}()
+}
+
+// drop remove a broken connection from the pool, so requests fail fast instead of
+// queueing on it until check, and reconnect it in background
+func (b *backend) drop(pc *pipeConn) {
+	dropped := false
+	b.lock.Lock()
+	for i, c := range b.conns {
+		if c == pc {
+			b.conns[i] = nil
+			dropped = true
+		}
+	}
+	b.lock.Unlock()
+	if !dropped {
+		return
+	}
+	log.Println("connection to", b.addr, "broken, reconnecting")
+	// check may be pinging it
+	b.checkLock.Lock()
+	pc.close()
+	b.checkLock.Unlock()
+	b.startReconnect()
+}
+
+// healthy tell if all connections to the node are established
+func (b *backend) healthy() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, pc := range b.conns {
+		if pc == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *backend) dialPipeConn() (*pipeConn, error) {
+	conn, err := b.dial(b.addr, b.proto)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pipeConn{
+		conn:     conn,
+		reqs:     make(chan *backendReq, PIPELINESIZE),
+		inflight: make(chan *backendReq, PIPELINESIZE),
+		wait:     b.poolWait,
+		broken:   b.drop,
+	}
+	go pc.writeLoop()
+	go pc.readLoop()
+	return pc, nil
+}
+
+// do send cmd through the connection picked by slot, requests of the same slot
+// always go through the same connection, so they are executed in order.
+// Requests in RESP3 go through connections speaking RESP3. A long bulk string
+// reply is streamed if fw.stream is set, nil is returned for it then
+func (b *backend) do(cmd []byte, slot uint16, ask bool, proto int, fw *forwarding) ([]byte, error) {
+	if proto == RESP3 && b.proto != RESP3 {
+		child := b.resp3Backend()
+		if child == nil {
+			return nil, clusterDownError(b.addr)
+		}
+		return child.do(cmd, slot, ask, proto, fw)
+	}
+	req := &backendReq{
+		cmd:    cmd,
+		ask:    ask,
+		queued: time.Now(),
+		done:   make(chan struct{}),
+	}
+	if fw != nil {
+		req.stream = fw.stream
+	}
+	atomic.AddUint64(&b.requests, 1)
+	b.lock.RLock()
+	pc := b.pick(slot)
+	if pc == nil {
+		err := dialError(b.addr, b.dialErr)
+		b.lock.RUnlock()
+		atomic.AddUint64(&b.errors, 1)
+		return nil, err
+	}
+	pc.reqs <- req
+	b.lock.RUnlock()
+	if fw != nil && fw.queued != nil {
+		fw.queued()
+	}
+	<-req.done
+	if req.err != nil && !isReplyError(req.err) {
+		atomic.AddUint64(&b.errors, 1)
+	}
+	return req.resp, req.err
+}
+
+// resp3Backend return the backend of the node speaking RESP3, nil if b is closed
+func (b *backend) resp3Backend() *backend {
+	b.resp3Lock.Lock()
+	defer b.resp3Lock.Unlock()
+	if b.resp3 == nil {
+		b.lock.RLock()
+		closed, size := b.closed, len(b.conns)
+		b.lock.RUnlock()
+		if closed {
+			return nil
+		}
+		log.Println("init RESP3 backend connection to", b.addr, ", pool size", size)
+		b.resp3 = newBackend(b.addr, size, RESP3, b.dial)
+	}
+	return b.resp3
+}
+
+// resp3Child return the backend speaking RESP3 if it's dialed
+func (b *backend) resp3Child() *backend {
+	b.resp3Lock.Lock()
+	defer b.resp3Lock.Unlock()
+	return b.resp3
+}
+
+// pick the connection of slot, or any established one if it's missing,
+// should be called with read lock held
+func (b *backend) pick(slot uint16) *pipeConn {
+	if b.closed {
+		return nil
+	}
+	if pc := b.conns[int(slot)%len(b.conns)]; pc != nil {
+		return pc
+	}
+	for _, pc := range b.conns {
+		if pc != nil {
+			return pc
+		}
+	}
+	return nil
+}
+
+// check ping every connection, broken ones are replaced with new connections,
+// the node is reconnected in background if it's unreachable
+func (b *backend) check(timeout time.Duration) {
+	b.checkLock.Lock()
+	defer b.checkLock.Unlock()
+	for i := 0; i < b.size(); i++ {
+		b.lock.RLock()
+		pc := b.conn(i)
+		b.lock.RUnlock()
+
+		if pc == nil {
+			continue
+		}
+		rtt, err := pc.ping(timeout)
+		if err == nil {
+			b.updateLatency(rtt)
+			continue
+		}
+		if err == errPingBusy {
+			continue
+		}
+		log.Println("connection to ", b.addr, " failed, replace with new one")
+		b.lock.Lock()
+		if b.conn(i) == pc {
+			b.conns[i] = nil
+		}
+		b.lock.Unlock()
+		pc.close()
+	}
+
+	b.lock.RLock()
+	reconnecting := b.reconnecting
+	b.lock.RUnlock()
+	if !reconnecting && b.redial() > 0 {
+		b.startReconnect()
+	}
+	if child := b.resp3Child(); child != nil {
+		child.check(timeout)
+	}
+}
+
+// size return the number of connections in the pool
+func (b *backend) size() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.conns)
+}
+
+// conn return the i-th connection, nil if it's missing or out of the pool,
+// should be called with read lock held
+func (b *backend) conn(i int) *pipeConn {
+	if i >= len(b.conns) {
+		return nil
+	}
+	return b.conns[i]
+}
+
+// reset replace connections with size new ones dialed with current config, old
+// connections are closed after requests queued on them are replied. Old connections
+// are kept if the node is unreachable
+func (b *backend) reset(size int) error {
+	b.checkLock.Lock()
+	defer b.checkLock.Unlock()
+	conns := make([]*pipeConn, size)
+	for i := range conns {
+		pc, err := b.dialPipeConn()
+		if err != nil {
+			for _, pc := range conns[:i] {
+				pc.close()
+			}
+			return err
+		}
+		conns[i] = pc
+	}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		for _, pc := range conns {
+			pc.close()
+		}
+		return nil
+	}
+	old := b.conns
+	b.conns = conns
+	b.dialErr = nil
+	b.lock.Unlock()
+	for _, pc := range old {
+		if pc != nil {
+			pc.drain()
+		}
+	}
+	if child := b.resp3Child(); child != nil {
+		return child.reset(size)
+	}
+	return nil
+}
+
+// close wait for check, which may be pinging connections
+func (b *backend) close() {
+	b.checkLock.Lock()
+	defer b.checkLock.Unlock()
+	b.lock.Lock()
+	b.closed = true
+	for i, pc := range b.conns {
+		if pc != nil {
+			pc.close()
+			b.conns[i] = nil
+		}
+	}
+	b.lock.Unlock()
+	if child := b.resp3Child(); child != nil {
+		child.close()
+	}
+}
+
+func (pc *pipeConn) writeLoop() {
+	for req := range pc.reqs {
+		if err := pc.getErr(); err != nil {
+			req.err = err
+			close(req.done)
+			continue
+		}
+		if pc.wait != nil && !req.queued.IsZero() {
+			pc.wait.observe(time.Since(req.queued))
+		}
+		if req.ask {
+			pc.conn.write(askingCmd)
+		}
+		pc.conn.write(req.cmd)
+		pc.inflight <- req
+		if len(pc.reqs) == 0 {
+			if err := pc.conn.flush(); err != nil {
+				pc.fail(err.Error())
+			}
+		}
+	}
+	close(pc.inflight)
+}
+
+func (pc *pipeConn) readLoop() {
+	for req := range pc.inflight {
+		if err := pc.getErr(); err != nil {
+			req.err = err
+			close(req.done)
+			continue
+		}
+		if req.ask {
+			if _, err := pc.conn.readRaw(); err != nil {
+				if !isReplyError(err) {
+					pc.fail(err.Error())
+				}
+				req.err = protocolError("ASKING failed " + err.Error())
+			}
+		}
+		var resp []byte
+		var err error
+		if req.stream != nil && req.err == nil {
+			var whole bool
+			if resp, whole, err = pc.readStream(req); !whole {
+				continue
+			}
+		} else {
+			resp, err = pc.conn.readRaw()
+		}
+		if err != nil && !isReplyError(err) {
+			pc.fail(err.Error())
+			err = pc.getErr()
+		}
+		if req.err == nil {
+			req.resp = resp
+			req.err = err
+		}
+		close(req.done)
+	}
+	// all requests are replied after the connection is drained
+	pc.fail("connection closed")
+}
+
+// ping return the round trip time, the connection fails if the reply takes longer
+// than timeout
+func (pc *pipeConn) ping(timeout time.Duration) (time.Duration, error) {
+	req := &backendReq{
+		cmd:  []byte("*1\r\n$4\r\nPING\r\n"),
+		done: make(chan struct{}),
+	}
+	begin := time.Now()
+	select {
+	case pc.reqs <- req:
+	default:
+		return 0, errPingBusy
+	}
+	select {
+	case <-req.done:
+		return time.Since(begin), req.err
+	case <-time.After(timeout):
+		pc.fail("ping timeout")
+		return 0, protocolError("ping timeout")
+	}
+}
+
+func (b *backend) updateLatency(rtt time.Duration) {
+	old := atomic.LoadInt64(&b.latency)
+	if old == 0 {
+		atomic.StoreInt64(&b.latency, int64(rtt))
+		return
+	}
+	atomic.StoreInt64(&b.latency, (old*7+int64(rtt)*3)/10)
+}
+
+// getLatency return moving average of ping latency, unknown latency is treated as the highest
+func (b *backend) getLatency() time.Duration {
+	latency := atomic.LoadInt64(&b.latency)
+	if latency == 0 {
+		return time.Hour
+	}
+	return time.Duration(latency)
+}
+
+// fail mark the connection broken, requests queued on it fail. The backend is
+// told in background, fail may be called with the backend locked
+func (pc *pipeConn) fail(reason string) {
+	pc.errLock.Lock()
+	defer pc.errLock.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = protocolError("connection to " + pc.conn.remoteAddr() + " broken, " + reason)
+	pc.conn.close()
+	if pc.broken != nil {
+		go pc.broken(pc)
+	}
+}
+
+func (pc *pipeConn) getErr() error {
+	pc.errLock.Lock()
+	defer pc.errLock.Unlock()
+	return pc.err
+}
+
+// close should be called only after the connection is not reachable by senders,
+// it may be called more than once
+func (pc *pipeConn) close() {
+	pc.fail("connection closed")
+	pc.drain()
+}
+
+// drain close the connection after requests queued on it are replied, it should be
+// called only after the connection is not reachable by senders
+func (pc *pipeConn) drain() {
+	pc.closeOnce.Do(func() { close(pc.reqs) })
+}
+
+// isReplyError tell an error reply from redis from a broken connection
+func isReplyError(err error) bool {
+	switch err.(type) {
+	case redisError, *movedError, *askError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeConnPing(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// no loop runs, requests stay queued
+	pc := &pipeConn{
+		conn:     NewConn(client, 0, 0),
+		reqs:     make(chan *backendReq, 1),
+		inflight: make(chan *backendReq, 1),
+	}
+
+	// a full queue means the connection is busy, it's not failed
+	pc.reqs <- &backendReq{done: make(chan struct{})}
+	if _, err := pc.ping(10 * time.Millisecond); err != errPingBusy {
+		t.Fatalf("got %v, want %v", err, errPingBusy)
+	}
+	if err := pc.getErr(); err != nil {
+		t.Fatalf("busy connection failed: %v", err)
+	}
+
+	// a queued ping without reply fails the connection after timeout
+	<-pc.reqs
+	begin := time.Now()
+	if _, err := pc.ping(50 * time.Millisecond); err == nil || err == errPingBusy {
+		t.Fatalf("got %v, want ping timeout", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Errorf("ping timed out after %v", elapsed)
+	}
+	if pc.getErr() == nil {
+		t.Error("connection not failed after ping timeout")
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BLOCKINGGRACE is how long a blocking command may take beyond its timeout, on top
+// of read timeout, before the proxy gives up the nil reply of the node
+const BLOCKINGGRACE = time.Second
+
+// blockingDo send a blocking command of slot over a dedicated connection, so it
+// never stalls pooled connections. The connection is closed if the command blocks
+// longer than timeout plus BLOCKINGGRACE and read timeout, or cancel is closed when
+// client disconnects. timeout 0 means the command may block forever
+func (p *proxy) blockingDo(cmd []byte, slot uint16, timeout time.Duration, cancel <-chan struct{}, proto int) ([]byte, error) {
+	key := blockingKey{p.nodeAddr(slot), proto}
+	resp, err := p.blockingDoAt(cmd, slot, key, false, timeout, cancel)
+	switch errVal := err.(type) {
+	case *movedError:
+		atomic.AddUint64(&p.movedCount, 1)
+		p.updateSlot(slot, errVal.Address)
+		return p.blockingDoAt(cmd, slot, blockingKey{errVal.Address, proto}, false, timeout, cancel)
+	case *askError:
+		atomic.AddUint64(&p.askCount, 1)
+		return p.blockingDoAt(cmd, slot, blockingKey{errVal.Address, proto}, true, timeout, cancel)
+	}
+	return resp, err
+}
+
+func (p *proxy) blockingDoAt(cmd []byte, slot uint16, key blockingKey, ask bool, timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
+	if key.addr == "" {
+		return nil, clusterDownError("")
+	}
+	conn, err := p.blockingConn(key)
+	if err != nil {
+		return nil, dialError(key.addr, err)
+	}
+
+	// watch the call, closing the connection interrupts the blocked read
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		var expire <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout + BLOCKINGGRACE + time.Duration(p.config().ReadTimeout)*time.Millisecond)
+			defer timer.Stop()
+			expire = timer.C
+		}
+		select {
+		case <-done:
+			interrupted <- nil
+		case <-cancel:
+			conn.close()
+			interrupted <- protocolError("client disconnected")
+		case <-expire:
+			conn.close()
+			interrupted <- protocolError("blocking cmd timeout")
+		}
+	}()
+
+	resp, err := p.blockingRoundTrip(conn, cmd, ask)
+	close(done)
+	if ierr := <-interrupted; ierr != nil {
+		return nil, ierr
+	}
+	if err != nil && !isReplyError(err) {
+		conn.close()
+		return nil, err
+	}
+	p.releaseBlockingConn(key, conn)
+	return resp, err
+}
+
+// blockingRoundTrip write cmd, prefixed by ASKING if ask, and read its reply
+func (p *proxy) blockingRoundTrip(conn RedisConn, cmd []byte, ask bool) ([]byte, error) {
+	if ask {
+		conn.write(askingCmd)
+	}
+	if err := conn.writeBytes(cmd); err != nil {
+		return nil, err
+	}
+	if ask {
+		if _, err := conn.readRaw(); err != nil {
+			if isReplyError(err) {
+				err = protocolError("ASKING failed " + err.Error())
+			}
+			return nil, err
+		}
+	}
+	return conn.readRaw()
+}
+
+// blockingKey identify idle connections for blocking commands, by node address
+// and protocol
+type blockingKey struct {
+	addr  string
+	proto int
+}
+
+// blockingConn return an idle connection for blocking commands to key, or dial one.
+// Idle connections may be closed by the node meanwhile, broken ones are dropped
+func (p *proxy) blockingConn(key blockingKey) (RedisConn, error) {
+	for {
+		p.blockingLock.Lock()
+		idle := p.blockingIdle[key]
+		n := len(idle)
+		if n == 0 {
+			p.blockingLock.Unlock()
+			return p.dedicatedConn(key.addr, 0, key.proto)
+		}
+		conn := idle[n-1]
+		p.blockingIdle[key] = idle[:n-1]
+		p.blockingLock.Unlock()
+		if err := p.pingIdle(conn); err == nil {
+			return conn, nil
+		}
+		conn.close()
+	}
+}
+
+// pingIdle check an idle connection, it has no read timeout so it's closed if PING
+// takes longer than ping timeout
+func (p *proxy) pingIdle(conn RedisConn) error {
+	timer := time.AfterFunc(p.config().pingTimeout(), func() {
+		conn.close()
+	})
+	err := conn.ping()
+	if !timer.Stop() {
+		return protocolError("ping idle connection timeout")
+	}
+	return err
+}
+
+// releaseBlockingConn keep at most poolSize idle connections to each node
+func (p *proxy) releaseBlockingConn(key blockingKey, conn RedisConn) {
+	p.blockingLock.Lock()
+	defer p.blockingLock.Unlock()
+	if len(p.blockingIdle[key]) >= p.config().PoolSize {
+		conn.close()
+		return
+	}
+	p.blockingIdle[key] = append(p.blockingIdle[key], conn)
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestPingIdle(t *testing.T) {
+	p := &proxy{}
+	p.conf.Store(&Config{ReadTimeout: 10, WriteTimeout: 10})
+	tests := []struct {
+		name string
+		// serve the peer of the idle connection
+		peer func(net.Conn)
+		ok   bool
+	}{
+		{"answered", func(c net.Conn) {
+			bufio.NewReader(c).ReadString('\n')
+			c.Write([]byte("+PONG\r\n"))
+		}, true},
+		{"silent", func(c net.Conn) {
+			bufio.NewReader(c).ReadString('\n')
+		}, false},
+		{"closed", func(c net.Conn) {
+			c.Close()
+		}, false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go test.peer(server)
+		err := p.pingIdle(NewConn(client, 0, 0))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
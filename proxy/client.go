@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientDo handle CLIENT subcommands locally, clients of the proxy are not
+// clients of cluster nodes
+func (sess *session) clientDo(proxy Proxy, args [][]byte) ([]byte, error) {
+	sub := strings.ToUpper(string(args[0]))
+	switch {
+	case sub == "ID" && len(args) == 1:
+		return encodeReply(int64(sess.id)), nil
+	case sub == "GETNAME" && len(args) == 1:
+		if name := sess.getName(); name != "" {
+			return encodeReply([]byte(name)), nil
+		}
+		return encodeReply(nil), nil
+	case sub == "SETNAME" && len(args) == 2:
+		name := string(args[1])
+		if strings.ContainsAny(name, " \n") {
+			return nil, redisError("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		sess.setName(name)
+		return encodeReply(okReply), nil
+	case sub == "LIST" && len(args) == 1:
+		var buf bytes.Buffer
+		for _, s := range liveSessions() {
+			buf.WriteString(s.describe())
+			buf.WriteString("\n")
+		}
+		return encodeReply(buf.Bytes()), nil
+	case sub == "KILL" && len(args) == 2:
+		// old form, CLIENT KILL addr, it may kill the session itself
+		if killSessions(&killFilter{addr: string(args[1])}, sess) == 0 {
+			return nil, redisError("ERR No such client")
+		}
+		return encodeReply(okReply), nil
+	case sub == "KILL" && len(args) >= 3 && len(args)%2 == 1:
+		filter, err := parseKillFilter(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return encodeReply(int64(killSessions(filter, sess))), nil
+	case sub == "TRACKING" && len(args) >= 2:
+		return sess.trackingDo(proxy, args[1:])
+	}
+	return nil, protocolError("unsupported cmd CLIENT " + sub)
+}
+
+// trackingDo handle CLIENT TRACKING ON|OFF [BCAST] [PREFIX prefix ...] [NOLOOP].
+// Keys are read through connections shared by sessions, so only broadcasting mode
+// works: a dedicated RESP3 connection to each master tracks the prefixes and its
+// invalidation messages are pushed to the client. Masters joining the cluster later
+// are not tracked
+func (sess *session) trackingDo(proxy Proxy, args [][]byte) ([]byte, error) {
+	sub := sess.sub
+	switch strings.ToUpper(string(args[0])) {
+	case "OFF":
+		sub.stopTracking()
+		return encodeReply(okReply), nil
+	case "ON":
+	default:
+		return nil, redisError("ERR syntax error")
+	}
+	bcast := false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BCAST":
+			bcast = true
+		case "PREFIX":
+			if i++; i == len(args) {
+				return nil, redisError("ERR syntax error")
+			}
+		case "NOLOOP":
+		case "REDIRECT", "OPTIN", "OPTOUT":
+			return nil, protocolError("CLIENT TRACKING " + strings.ToUpper(string(args[i])) + " is not supported")
+		default:
+			return nil, redisError("ERR syntax error")
+		}
+	}
+	switch {
+	case !bcast:
+		return nil, protocolError("only BCAST mode of CLIENT TRACKING is supported")
+	case sess.proto != RESP3:
+		return nil, protocolError("CLIENT TRACKING needs RESP3, switch by HELLO 3")
+	}
+
+	sub.stopTracking()
+	cmd := encodeCmd(append([][]byte{[]byte("CLIENT"), []byte("TRACKING")}, args...))
+	for _, addr := range proxy.masters() {
+		conn, err := proxy.dedicatedConn(addr, 0, RESP3)
+		if err != nil {
+			sub.stopTracking()
+			return nil, dialError(addr, err)
+		}
+		conn.writeBytes(cmd)
+		_, err = conn.readReply()
+		conn.clear()
+		if err != nil {
+			conn.close()
+			sub.stopTracking()
+			return nil, err
+		}
+		sub.lock.Lock()
+		sub.trackConns = append(sub.trackConns, conn)
+		sub.lock.Unlock()
+		sub.pumps.Add(1)
+		go sess.pump(conn)
+	}
+	return encodeReply(okReply), nil
+}
+
+// killFilter is filters of CLIENT KILL, sessions matching all of them are killed
+type killFilter struct {
+	// 0 if sessions are not filtered by id
+	id   uint64
+	addr string
+	// skip the session issuing CLIENT KILL
+	skipMe bool
+}
+
+// parseKillFilter parse `filter value` pairs of CLIENT KILL, SKIPME is yes by default
+func parseKillFilter(args [][]byte) (*killFilter, error) {
+	f := &killFilter{skipMe: true}
+	for i := 0; i+1 < len(args); i += 2 {
+		value := string(args[i+1])
+		switch filter := strings.ToUpper(string(args[i])); filter {
+		case "ID":
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || id == 0 {
+				return nil, redisError("ERR client-id should be greater than 0")
+			}
+			f.id = id
+		case "ADDR":
+			f.addr = value
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				f.skipMe = true
+			case "no":
+				f.skipMe = false
+			default:
+				return nil, redisError("ERR syntax error")
+			}
+		case "LADDR", "TYPE", "USER", "MAXAGE":
+			return nil, protocolError("CLIENT KILL " + filter + " is not supported")
+		default:
+			return nil, redisError("ERR syntax error")
+		}
+	}
+	return f, nil
+}
+
+// match tell if s matches all filters, self is the session issuing CLIENT KILL
+func (f *killFilter) match(s *session, self *session) bool {
+	switch {
+	case f.skipMe && s == self:
+		return false
+	case f.id != 0 && s.id != f.id:
+		return false
+	case f.addr != "" && s.remoteAddr() != f.addr:
+		return false
+	}
+	return true
+}
+
+// killSessions close sessions matching filter, return the number killed
+func killSessions(filter *killFilter, self *session) int {
+	killed := 0
+	for _, s := range liveSessions() {
+		if filter.match(s, self) {
+			// reader of the session fails and the session closes itself
+			s.cliConn.close()
+			killed++
+		}
+	}
+	return killed
+}
+
+func (sess *session) getName() string {
+	sess.nameLock.Lock()
+	defer sess.nameLock.Unlock()
+	return sess.name
+}
+
+func (sess *session) setName(name string) {
+	sess.nameLock.Lock()
+	sess.name = name
+	sess.nameLock.Unlock()
+}
+
+// describe the session in the format of CLIENT LIST
+func (sess *session) describe() string {
+	now := time.Now()
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&sess.lastActive)))
+	cmd, _ := sess.lastCmd.Load().(string)
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	return "id=" + strconv.FormatUint(sess.id, 10) +
+		" addr=" + sess.remoteAddr() +
+		" name=" + sess.getName() +
+		" age=" + strconv.Itoa(int(now.Sub(sess.ts).Seconds())) +
+		" idle=" + strconv.Itoa(int(idle.Seconds())) +
+		" ops=" + strconv.FormatUint(atomic.LoadUint64(&sess.ops), 10) +
+		" cmd=" + strings.ToLower(cmd)
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKillFilter(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	self := NewSession(client).(*session)
+	self.id = 1
+	other := NewSession(server).(*session)
+	other.id = 2
+	addr := other.remoteAddr()
+
+	tests := []struct {
+		args string
+		err  string
+		// whether self and other are killed
+		self, other bool
+	}{
+		{args: "ID 2", other: true},
+		{args: "ID 1"},
+		{args: "ID 1 SKIPME no", self: true},
+		{args: "ADDR " + addr, other: true},
+		{args: "ADDR " + addr + " SKIPME no", self: true, other: true},
+		// filters are ANDed
+		{args: "ID 2 ADDR " + addr, other: true},
+		{args: "ID 1 ADDR " + addr + " SKIPME no", self: true},
+		{args: "ID 2 ADDR 127.0.0.1:1"},
+		{args: "ID 0", err: "ERR client-id should be greater than 0"},
+		{args: "ID x", err: "ERR client-id should be greater than 0"},
+		{args: "SKIPME maybe", err: "ERR syntax error"},
+		{args: "NAME x", err: "ERR syntax error"},
+		{args: "USER default", err: "CLIENT KILL USER is not supported"},
+		{args: "TYPE normal", err: "CLIENT KILL TYPE is not supported"},
+	}
+	for _, test := range tests {
+		var args [][]byte
+		for _, f := range strings.Fields(test.args) {
+			args = append(args, []byte(f))
+		}
+		f, err := parseKillFilter(args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if f.match(self, self) != test.self || f.match(other, self) != test.other {
+			t.Errorf("%q: killed self %v other %v, want %v %v", test.args,
+				f.match(self, self), f.match(other, self), test.self, test.other)
+		}
+	}
+}
@@ -1,24 +1,620 @@
 package proxy
 
-var cmd_deny = []string{
-	"CLUSTER", "READONLY", "READWRITE",
-	"AUTH", "ECHO", "SELECT",
-	"PFADD", "PFCOUNT", "PFMERGE",
-	"KEYS", "MIGRATE", "MOVE", "OBJECT", "RANDOMKEY", "RENAME", "RENAMENX", "WAIT", "SCAN",
-	"BLPOP", "BRPOP", "BRPOPLPUSH", "RPOPLPUSH",
-	"PSUBSCRIBE", "PUBSUB", "PUBLISH", "PUNSUBSCRIBE", "SUBSCRIBE", "UNSUBSCRIBE",
-	"EVAL", "EVALSHA", "SCRIPT",
-	"BGREWRITEAOF", "BGSAVE", "CLIENT", "COMMAND", "CONFIG", "DBSIZE", "DEBUG",
-	"FLUSHALL", "FLUSHDB", "INFO", "LASTSAVE", "MONITOR", "ROLE", "SAVE", "SHUTDOWN", "SLAVEOF", "SLOWLOG", "SYNC", "TIME",
-	"SDIFF", "SDIFFSTORE", "SINTER", "SINTERSTORE", "SMOVE", "SUNION", "SUNIONSTORE",
-	"ZINTERSTORE", "ZUNIONSTORE", "BITOP",
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command flags, same meaning as flags in reply of redis COMMAND INFO,
+// except CmdDeny which means the command is not supported by proxy
+const (
+	CmdWrite = 1 << iota
+	CmdReadonly
+	CmdAdmin
+	CmdBlocking
+	CmdPubsub
+	CmdNoscript
+	CmdMovableKeys
+	CmdDeny
+)
+
+var cmdFlagNames = map[string]int{
+	"write":       CmdWrite,
+	"readonly":    CmdReadonly,
+	"admin":       CmdAdmin,
+	"blocking":    CmdBlocking,
+	"pubsub":      CmdPubsub,
+	"noscript":    CmdNoscript,
+	"movablekeys": CmdMovableKeys,
+}
+
+// commandInfo has the layout of redis COMMAND INFO, key positions count the
+// command name as position 0, negative lastKey counts from the end
+type commandInfo struct {
+	name     string
+	arity    int
+	flags    int
+	firstKey int
+	lastKey  int
+	step     int
+}
+
+const (
+	rd  = CmdReadonly
+	wr  = CmdWrite
+	adm = CmdAdmin | CmdDeny
+	blk = CmdBlocking
+	mov = CmdMovableKeys
+	ps  = CmdPubsub
+	dny = CmdDeny
+)
+
+var commands = []commandInfo{
+	// strings
+	{"APPEND", 3, wr, 1, 1, 1},
+	{"DECR", 2, wr, 1, 1, 1},
+	{"DECRBY", 3, wr, 1, 1, 1},
+	{"GET", 2, rd, 1, 1, 1},
+	{"GETDEL", 2, wr, 1, 1, 1},
+	{"GETEX", -2, wr, 1, 1, 1},
+	{"GETRANGE", 4, rd, 1, 1, 1},
+	{"GETSET", 3, wr, 1, 1, 1},
+	{"INCR", 2, wr, 1, 1, 1},
+	{"INCRBY", 3, wr, 1, 1, 1},
+	{"INCRBYFLOAT", 3, wr, 1, 1, 1},
+	{"LCS", -3, rd, 1, 2, 1},
+	{"MGET", -2, rd, 1, -1, 1},
+	{"MSET", -3, wr, 1, -1, 2},
+	{"MSETNX", -3, wr, 1, -1, 2},
+	{"PSETEX", 4, wr, 1, 1, 1},
+	{"SET", -3, wr, 1, 1, 1},
+	{"SETEX", 4, wr, 1, 1, 1},
+	{"SETNX", 3, wr, 1, 1, 1},
+	{"SETRANGE", 4, wr, 1, 1, 1},
+	{"STRLEN", 2, rd, 1, 1, 1},
+	{"SUBSTR", 4, rd, 1, 1, 1},
+	// keys
+	{"COPY", -3, wr, 1, 2, 1},
+	{"DEL", -2, wr, 1, -1, 1},
+	{"DUMP", 2, rd, 1, 1, 1},
+	{"EXISTS", -2, rd, 1, -1, 1},
+	{"EXPIRE", -3, wr, 1, 1, 1},
+	{"EXPIREAT", -3, wr, 1, 1, 1},
+	{"EXPIRETIME", 2, rd, 1, 1, 1},
+	{"KEYS", 2, rd, 0, 0, 0},
+	{"MIGRATE", -6, wr | mov, 3, 3, 1},
+	{"MOVE", 3, wr | dny, 1, 1, 1},
+	{"OBJECT", -2, rd, 2, 2, 1},
+	{"PERSIST", 2, wr, 1, 1, 1},
+	{"PEXPIRE", -3, wr, 1, 1, 1},
+	{"PEXPIREAT", -3, wr, 1, 1, 1},
+	{"PEXPIRETIME", 2, rd, 1, 1, 1},
+	{"PTTL", 2, rd, 1, 1, 1},
+	{"RANDOMKEY", 1, rd, 0, 0, 0},
+	{"RENAME", 3, wr, 1, 2, 1},
+	{"RENAMENX", 3, wr, 1, 2, 1},
+	{"RESTORE", -4, wr, 1, 1, 1},
+	{"SCAN", -2, rd, 0, 0, 0},
+	{"SORT", -2, wr | mov, 1, 1, 1},
+	{"SORT_RO", -2, rd, 1, 1, 1},
+	{"TOUCH", -2, rd, 1, -1, 1},
+	{"TTL", 2, rd, 1, 1, 1},
+	{"TYPE", 2, rd, 1, 1, 1},
+	{"UNLINK", -2, wr, 1, -1, 1},
+	{"WAIT", 3, dny, 0, 0, 0},
+	// bitmaps
+	{"BITCOUNT", -2, rd, 1, 1, 1},
+	{"BITFIELD", -2, wr, 1, 1, 1},
+	{"BITFIELD_RO", -2, rd, 1, 1, 1},
+	{"BITOP", -4, wr, 2, -1, 1},
+	{"BITPOS", -3, rd, 1, 1, 1},
+	{"GETBIT", 3, rd, 1, 1, 1},
+	{"SETBIT", 4, wr, 1, 1, 1},
+	// lists
+	{"BLMOVE", 6, wr | blk, 1, 2, 1},
+	{"BLMPOP", -5, wr | blk | mov, 0, 0, 0},
+	{"BLPOP", -3, wr | blk, 1, -2, 1},
+	{"BRPOP", -3, wr | blk, 1, -2, 1},
+	{"BRPOPLPUSH", 4, wr | blk, 1, 2, 1},
+	{"LINDEX", 3, rd, 1, 1, 1},
+	{"LINSERT", 5, wr, 1, 1, 1},
+	{"LLEN", 2, rd, 1, 1, 1},
+	{"LMOVE", 5, wr, 1, 2, 1},
+	{"LMPOP", -4, wr | mov, 0, 0, 0},
+	{"LPOP", -2, wr, 1, 1, 1},
+	{"LPOS", -3, rd, 1, 1, 1},
+	{"LPUSH", -3, wr, 1, 1, 1},
+	{"LPUSHX", -3, wr, 1, 1, 1},
+	{"LRANGE", 4, rd, 1, 1, 1},
+	{"LREM", 4, wr, 1, 1, 1},
+	{"LSET", 4, wr, 1, 1, 1},
+	{"LTRIM", 4, wr, 1, 1, 1},
+	{"RPOP", -2, wr, 1, 1, 1},
+	{"RPOPLPUSH", 3, wr, 1, 2, 1},
+	{"RPUSH", -3, wr, 1, 1, 1},
+	{"RPUSHX", -3, wr, 1, 1, 1},
+	// hashes
+	{"HDEL", -3, wr, 1, 1, 1},
+	{"HEXISTS", 3, rd, 1, 1, 1},
+	{"HGET", 3, rd, 1, 1, 1},
+	{"HGETALL", 2, rd, 1, 1, 1},
+	{"HINCRBY", 4, wr, 1, 1, 1},
+	{"HINCRBYFLOAT", 4, wr, 1, 1, 1},
+	{"HKEYS", 2, rd, 1, 1, 1},
+	{"HLEN", 2, rd, 1, 1, 1},
+	{"HMGET", -3, rd, 1, 1, 1},
+	{"HMSET", -4, wr, 1, 1, 1},
+	{"HRANDFIELD", -2, rd, 1, 1, 1},
+	{"HSCAN", -3, rd, 1, 1, 1},
+	{"HSET", -4, wr, 1, 1, 1},
+	{"HSETNX", 4, wr, 1, 1, 1},
+	{"HSTRLEN", 3, rd, 1, 1, 1},
+	{"HVALS", 2, rd, 1, 1, 1},
+	// sets
+	{"SADD", -3, wr, 1, 1, 1},
+	{"SCARD", 2, rd, 1, 1, 1},
+	{"SDIFF", -2, rd, 1, -1, 1},
+	{"SDIFFSTORE", -3, wr, 1, -1, 1},
+	{"SINTER", -2, rd, 1, -1, 1},
+	{"SINTERCARD", -3, rd | mov, 0, 0, 0},
+	{"SINTERSTORE", -3, wr, 1, -1, 1},
+	{"SISMEMBER", 3, rd, 1, 1, 1},
+	{"SMEMBERS", 2, rd, 1, 1, 1},
+	{"SMISMEMBER", -3, rd, 1, 1, 1},
+	{"SMOVE", 4, wr, 1, 2, 1},
+	{"SPOP", -2, wr, 1, 1, 1},
+	{"SRANDMEMBER", -2, rd, 1, 1, 1},
+	{"SREM", -3, wr, 1, 1, 1},
+	{"SSCAN", -3, rd, 1, 1, 1},
+	{"SUNION", -2, rd, 1, -1, 1},
+	{"SUNIONSTORE", -3, wr, 1, -1, 1},
+	// sorted sets
+	{"BZMPOP", -5, wr | blk | mov, 0, 0, 0},
+	{"BZPOPMAX", -3, wr | blk, 1, -2, 1},
+	{"BZPOPMIN", -3, wr | blk, 1, -2, 1},
+	{"ZADD", -4, wr, 1, 1, 1},
+	{"ZCARD", 2, rd, 1, 1, 1},
+	{"ZCOUNT", 4, rd, 1, 1, 1},
+	{"ZDIFF", -3, rd | mov, 0, 0, 0},
+	{"ZDIFFSTORE", -4, wr | mov, 1, 1, 1},
+	{"ZINCRBY", 4, wr, 1, 1, 1},
+	{"ZINTER", -3, rd | mov, 0, 0, 0},
+	{"ZINTERCARD", -3, rd | mov, 0, 0, 0},
+	{"ZINTERSTORE", -4, wr | mov, 1, 1, 1},
+	{"ZLEXCOUNT", 4, rd, 1, 1, 1},
+	{"ZMPOP", -4, wr | mov, 0, 0, 0},
+	{"ZMSCORE", -3, rd, 1, 1, 1},
+	{"ZPOPMAX", -2, wr, 1, 1, 1},
+	{"ZPOPMIN", -2, wr, 1, 1, 1},
+	{"ZRANDMEMBER", -2, rd, 1, 1, 1},
+	{"ZRANGE", -4, rd, 1, 1, 1},
+	{"ZRANGEBYLEX", -4, rd, 1, 1, 1},
+	{"ZRANGEBYSCORE", -4, rd, 1, 1, 1},
+	{"ZRANGESTORE", -5, wr, 1, 2, 1},
+	{"ZRANK", -3, rd, 1, 1, 1},
+	{"ZREM", -3, wr, 1, 1, 1},
+	{"ZREMRANGEBYLEX", 4, wr, 1, 1, 1},
+	{"ZREMRANGEBYRANK", 4, wr, 1, 1, 1},
+	{"ZREMRANGEBYSCORE", 4, wr, 1, 1, 1},
+	{"ZREVRANGE", -4, rd, 1, 1, 1},
+	{"ZREVRANGEBYLEX", -4, rd, 1, 1, 1},
+	{"ZREVRANGEBYSCORE", -4, rd, 1, 1, 1},
+	{"ZREVRANK", -3, rd, 1, 1, 1},
+	{"ZSCAN", -3, rd, 1, 1, 1},
+	{"ZSCORE", 3, rd, 1, 1, 1},
+	{"ZUNION", -3, rd | mov, 0, 0, 0},
+	{"ZUNIONSTORE", -4, wr | mov, 1, 1, 1},
+	// hyperloglog
+	{"PFADD", -2, wr, 1, 1, 1},
+	{"PFCOUNT", -2, rd, 1, -1, 1},
+	{"PFMERGE", -2, wr, 1, -1, 1},
+	// geo
+	{"GEOADD", -5, wr, 1, 1, 1},
+	{"GEODIST", -4, rd, 1, 1, 1},
+	{"GEOHASH", -2, rd, 1, 1, 1},
+	{"GEOPOS", -2, rd, 1, 1, 1},
+	{"GEORADIUS", -6, wr | mov, 1, 1, 1},
+	{"GEORADIUSBYMEMBER", -5, wr | mov, 1, 1, 1},
+	{"GEORADIUSBYMEMBER_RO", -5, rd, 1, 1, 1},
+	{"GEORADIUS_RO", -6, rd, 1, 1, 1},
+	{"GEOSEARCH", -7, rd, 1, 1, 1},
+	{"GEOSEARCHSTORE", -8, wr, 1, 2, 1},
+	// streams
+	{"XACK", -4, wr, 1, 1, 1},
+	{"XADD", -5, wr, 1, 1, 1},
+	{"XAUTOCLAIM", -6, wr, 1, 1, 1},
+	{"XCLAIM", -6, wr, 1, 1, 1},
+	{"XDEL", -3, wr, 1, 1, 1},
+	{"XGROUP", -2, wr, 2, 2, 1},
+	{"XINFO", -2, rd, 2, 2, 1},
+	{"XLEN", 2, rd, 1, 1, 1},
+	{"XPENDING", -3, rd, 1, 1, 1},
+	{"XRANGE", -4, rd, 1, 1, 1},
+	{"XREAD", -4, rd | blk | mov, 0, 0, 0},
+	{"XREADGROUP", -7, wr | blk | mov, 0, 0, 0},
+	{"XREVRANGE", -4, rd, 1, 1, 1},
+	{"XSETID", -3, wr, 1, 1, 1},
+	{"XTRIM", -4, wr, 1, 1, 1},
+	// scripting
+	{"EVAL", -3, CmdNoscript | mov, 0, 0, 0},
+	{"EVALSHA", -3, CmdNoscript | mov, 0, 0, 0},
+	{"EVAL_RO", -3, rd | CmdNoscript | mov, 0, 0, 0},
+	{"EVALSHA_RO", -3, rd | CmdNoscript | mov, 0, 0, 0},
+	{"FCALL", -3, CmdNoscript | mov | dny, 0, 0, 0},
+	{"FCALL_RO", -3, rd | CmdNoscript | mov | dny, 0, 0, 0},
+	{"FUNCTION", -2, CmdNoscript | dny, 0, 0, 0},
+	{"SCRIPT", -2, CmdNoscript, 0, 0, 0},
+	// pubsub
+	{"PSUBSCRIBE", -2, ps, 0, 0, 0},
+	{"PUBLISH", 3, ps, 0, 0, 0},
+	{"PUBSUB", -2, ps | dny, 0, 0, 0},
+	{"PUNSUBSCRIBE", -1, ps, 0, 0, 0},
+	{"SPUBLISH", 3, ps, 1, 1, 1},
+	{"SSUBSCRIBE", -2, ps, 1, -1, 1},
+	{"SUBSCRIBE", -2, ps, 0, 0, 0},
+	{"SUNSUBSCRIBE", -1, ps, 1, -1, 1},
+	{"UNSUBSCRIBE", -1, ps, 0, 0, 0},
+	// transactions
+	{"DISCARD", 1, CmdNoscript, 0, 0, 0},
+	{"EXEC", 1, CmdNoscript, 0, 0, 0},
+	{"MULTI", 1, CmdNoscript, 0, 0, 0},
+	{"UNWATCH", 1, CmdNoscript, 0, 0, 0},
+	{"WATCH", -2, CmdNoscript, 1, -1, 1},
+	// connection
+	{"AUTH", -2, CmdNoscript, 0, 0, 0},
+	{"CLIENT", -2, CmdAdmin, 0, 0, 0},
+	{"ECHO", 2, dny, 0, 0, 0},
+	{"HELLO", -1, CmdNoscript, 0, 0, 0},
+	{"PING", -1, 0, 0, 0, 0},
+	{"QUIT", -1, 0, 0, 0, 0},
+	{"READONLY", 1, 0, 0, 0, 0},
+	{"READWRITE", 1, 0, 0, 0, 0},
+	{"RESET", 1, CmdNoscript | dny, 0, 0, 0},
+	{"SELECT", 2, dny, 0, 0, 0},
+	// server
+	{"ACL", -2, adm, 0, 0, 0},
+	{"BGREWRITEAOF", 1, adm, 0, 0, 0},
+	{"BGSAVE", -1, adm, 0, 0, 0},
+	{"CLUSTER", -2, adm, 0, 0, 0},
+	{"COMMAND", -1, dny, 0, 0, 0},
+	{"CONFIG", -2, adm, 0, 0, 0},
+	{"DBSIZE", 1, rd, 0, 0, 0},
+	{"DEBUG", -2, adm, 0, 0, 0},
+	{"FAILOVER", -1, adm, 0, 0, 0},
+	{"FLUSHALL", -1, wr, 0, 0, 0},
+	{"FLUSHDB", -1, wr, 0, 0, 0},
+	{"INFO", -1, 0, 0, 0, 0},
+	{"LASTSAVE", 1, dny, 0, 0, 0},
+	{"LATENCY", -2, adm, 0, 0, 0},
+	{"MEMORY", -2, rd | dny, 2, 2, 1},
+	{"MODULE", -2, adm, 0, 0, 0},
+	{"MONITOR", 1, adm, 0, 0, 0},
+	{"PSYNC", -3, adm, 0, 0, 0},
+	{"REPLICAOF", 3, adm, 0, 0, 0},
+	{"ROLE", 1, dny, 0, 0, 0},
+	{"SAVE", 1, adm, 0, 0, 0},
+	{"SHUTDOWN", -1, adm, 0, 0, 0},
+	{"SLAVEOF", 3, adm, 0, 0, 0},
+	{"SLOWLOG", -2, adm, 0, 0, 0},
+	{"SWAPDB", 3, wr | dny, 0, 0, 0},
+	{"SYNC", 1, adm, 0, 0, 0},
+	{"TIME", 1, 0, 0, 0, 0},
+}
+
+// movableKeys find keys of commands whose key positions depend on arguments,
+// args doesn't contain the command name
+var movableKeys = map[string]func([][]byte) [][]byte{
+	"EVAL":              numKeysAt(1, 0),
+	"EVALSHA":           numKeysAt(1, 0),
+	"EVAL_RO":           numKeysAt(1, 0),
+	"EVALSHA_RO":        numKeysAt(1, 0),
+	"FCALL":             numKeysAt(1, 0),
+	"FCALL_RO":          numKeysAt(1, 0),
+	"BLMPOP":            numKeysAt(1, 0),
+	"BZMPOP":            numKeysAt(1, 0),
+	"LMPOP":             numKeysAt(0, 0),
+	"ZMPOP":             numKeysAt(0, 0),
+	"SINTERCARD":        numKeysAt(0, 0),
+	"ZINTERCARD":        numKeysAt(0, 0),
+	"ZDIFF":             numKeysAt(0, 0),
+	"ZINTER":            numKeysAt(0, 0),
+	"ZUNION":            numKeysAt(0, 0),
+	"ZDIFFSTORE":        numKeysAt(1, 1),
+	"ZINTERSTORE":       numKeysAt(1, 1),
+	"ZUNIONSTORE":       numKeysAt(1, 1),
+	"XREAD":             streamKeys,
+	"XREADGROUP":        streamKeys,
+	"MIGRATE":           migrateKeys,
+	"SORT":              storeKeys,
+	"GEORADIUS":         storeKeys,
+	"GEORADIUSBYMEMBER": storeKeys,
+}
+
+var (
+	// commands before allow_commands and deny_commands of config apply
+	baseTable    = make(map[string]*commandInfo)
+	commandTable = make(map[string]*commandInfo)
+	// commands allowed or denied by config
+	allowedCmds map[string]bool
+	deniedCmds  map[string]bool
+	commandLock sync.RWMutex
+)
+
+func init() {
+	for i := range commands {
+		baseTable[commands[i].name] = &commands[i]
+		commandTable[commands[i].name] = &commands[i]
+	}
+}
+
+// setCommandRules allow commands denied by default or deny more commands, it
+// applies to requests read after it returns
+func setCommandRules(allow []string, deny []string) {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	allowedCmds = make(map[string]bool)
+	for _, name := range allow {
+		allowedCmds[strings.ToUpper(name)] = true
+	}
+	deniedCmds = make(map[string]bool)
+	for _, name := range deny {
+		deniedCmds[strings.ToUpper(name)] = true
+	}
+	commandTable = applyCommandRules(baseTable)
+}
+
+// applyCommandRules return a copy of base with rules of config applied, should be
+// called with lock held
+func applyCommandRules(base map[string]*commandInfo) map[string]*commandInfo {
+	table := make(map[string]*commandInfo, len(base))
+	for name, c := range base {
+		if deniedCmds[name] && c.flags&CmdDeny == 0 {
+			denied := *c
+			denied.flags |= CmdDeny
+			c = &denied
+		} else if allowedCmds[name] && c.flags&CmdDeny != 0 {
+			allowed := *c
+			allowed.flags &^= CmdDeny
+			c = &allowed
+		}
+		table[name] = c
+	}
+	return table
+}
+
+// lookupCommand return nil if cmd is unknown, the returned commandInfo must not be modified
+func lookupCommand(cmd string) *commandInfo {
+	commandLock.RLock()
+	defer commandLock.RUnlock()
+	return commandTable[cmd]
 }
 
 func UnsupportedCmd(cmd string) bool {
-	for _, c := range cmd_deny {
-		if c == cmd {
+	c := lookupCommand(cmd)
+	return c == nil || c.flags&CmdDeny != 0
+}
+
+// checkArity check number of arguments, argc includes the command name
+func (c *commandInfo) checkArity(argc int) bool {
+	if c.arity >= 0 {
+		return argc == c.arity
+	}
+	return argc >= -c.arity
+}
+
+// keys return keys in args, args doesn't contain the command name
+func (c *commandInfo) keys(args [][]byte) [][]byte {
+	if fn, ok := movableKeys[c.name]; ok {
+		return fn(args)
+	}
+	if c.firstKey <= 0 || c.firstKey > len(args) {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	step := c.step
+	if step <= 0 {
+		step = 1
+	}
+	keys := make([][]byte, 0, 1)
+	for i := c.firstKey; i <= last && i <= len(args); i += step {
+		keys = append(keys, args[i-1])
+	}
+	return keys
+}
+
+// numKeysAt return a function find keys of command like EVAL, numkeys is at args[at],
+// followed by keys, `before` keys are before numkeys
+func numKeysAt(at int, before int) func([][]byte) [][]byte {
+	return func(args [][]byte) [][]byte {
+		if at >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(string(args[at]))
+		if err != nil || n < 0 || at+1+n > len(args) {
+			return nil
+		}
+		keys := make([][]byte, 0, before+n)
+		keys = append(keys, args[:before]...)
+		return append(keys, args[at+1:at+1+n]...)
+	}
+}
+
+// streamKeys find keys of XREAD and XREADGROUP, keys are after STREAMS followed by ids
+func streamKeys(args [][]byte) [][]byte {
+	for i, arg := range args {
+		if strings.ToUpper(string(arg)) != "STREAMS" {
+			continue
+		}
+		rest := args[i+1:]
+		if len(rest) == 0 || len(rest)%2 != 0 {
+			return nil
+		}
+		return rest[:len(rest)/2]
+	}
+	return nil
+}
+
+// migrateKeys find keys of MIGRATE, the key is empty when KEYS option is used
+func migrateKeys(args [][]byte) [][]byte {
+	if len(args) < 3 {
+		return nil
+	}
+	if len(args[2]) > 0 {
+		return args[2:3]
+	}
+	for i := 5; i < len(args); i++ {
+		if strings.ToUpper(string(args[i])) == "KEYS" {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+// storeKeys find keys of SORT and GEORADIUS, the first key and the key after STORE
+func storeKeys(args [][]byte) [][]byte {
+	if len(args) == 0 {
+		return nil
+	}
+	keys := [][]byte{args[0]}
+	for i := 1; i < len(args)-1; i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if opt == "STORE" || opt == "STOREDIST" {
+			keys = append(keys, args[i+1])
+			i++
+		}
+	}
+	return keys
+}
+
+// keysSlot return slot of keys, -1 if keys hash to different slots
+func keysSlot(keys [][]byte) int {
+	if len(keys) == 0 {
+		return -1
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return -1
+		}
+	}
+	return int(slot)
+}
+
+// blocks tell if the command may block, XREAD and XREADGROUP block only with BLOCK option
+func (c *commandInfo) blocks(args [][]byte) bool {
+	if c.flags&CmdBlocking == 0 {
+		return false
+	}
+	if c.name != "XREAD" && c.name != "XREADGROUP" {
+		return true
+	}
+	for _, arg := range args {
+		if bytes.EqualFold(arg, []byte("BLOCK")) {
 			return true
 		}
+		if bytes.EqualFold(arg, []byte("STREAMS")) {
+			break
+		}
 	}
 	return false
 }
+
+// blockTimeout return how long a blocking command may block, 0 means forever or
+// unknown. Timeouts are in seconds except BLOCK of XREAD and XREADGROUP
+func (c *commandInfo) blockTimeout(args [][]byte) time.Duration {
+	if len(args) == 0 {
+		return 0
+	}
+	var arg []byte
+	unit := time.Second
+	switch c.name {
+	case "BLMPOP", "BZMPOP":
+		arg = args[0]
+	case "XREAD", "XREADGROUP":
+		for i, a := range args[:len(args)-1] {
+			if bytes.EqualFold(a, []byte("BLOCK")) {
+				arg = args[i+1]
+				break
+			}
+		}
+		unit = time.Millisecond
+	default:
+		// BLPOP, BRPOP, BRPOPLPUSH, BLMOVE, BZPOPMIN, BZPOPMAX
+		arg = args[len(args)-1]
+	}
+	timeout, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || timeout <= 0 {
+		return 0
+	}
+	return time.Duration(timeout * float64(unit))
+}
+
+// refreshCommandTable update the table with reply of COMMAND. Key positions of a known
+// command are kept when backend reports none, e.g. container commands like OBJECT.
+// New commands are denied unless they are simple keyed commands
+func refreshCommandTable(reply interface{}) (int, error) {
+	entries, ok := reply.([]interface{})
+	if !ok {
+		return 0, protocolError("bad COMMAND reply")
+	}
+
+	table := make(map[string]*commandInfo)
+	commandLock.RLock()
+	for name, c := range baseTable {
+		table[name] = c
+	}
+	commandLock.RUnlock()
+
+	n := 0
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) < 6 {
+			return n, protocolError("bad COMMAND reply entry")
+		}
+		name, ok1 := fields[0].([]byte)
+		arity, ok2 := fields[1].(int64)
+		flagList, ok3 := fields[2].([]interface{})
+		firstKey, ok4 := fields[3].(int64)
+		lastKey, ok5 := fields[4].(int64)
+		step, ok6 := fields[5].(int64)
+		if !(ok1 && ok2 && ok3 && ok4 && ok5 && ok6) {
+			return n, protocolError("bad COMMAND reply entry")
+		}
+
+		c := &commandInfo{
+			name:     strings.ToUpper(string(name)),
+			arity:    int(arity),
+			firstKey: int(firstKey),
+			lastKey:  int(lastKey),
+			step:     int(step),
+		}
+		for _, f := range flagList {
+			if s, ok := f.(string); ok {
+				c.flags |= cmdFlagNames[s]
+			}
+		}
+
+		if old, ok := table[c.name]; ok {
+			c.flags |= old.flags & CmdDeny
+			if c.firstKey == 0 {
+				c.firstKey, c.lastKey, c.step = old.firstKey, old.lastKey, old.step
+			}
+		} else if c.firstKey == 0 || c.flags&(CmdAdmin|CmdPubsub|CmdBlocking|CmdMovableKeys) != 0 {
+			c.flags |= CmdDeny
+		}
+		table[c.name] = c
+		n++
+	}
+
+	commandLock.Lock()
+	baseTable = table
+	commandTable = applyCommandRules(table)
+	commandLock.Unlock()
+	return n, nil
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArgs split line into the command name and its args
+func testArgs(line string) (string, [][]byte) {
+	fields := strings.Fields(line)
+	args := make([][]byte, 0, len(fields))
+	for _, f := range fields[1:] {
+		// "" is an empty argument
+		if f == `""` {
+			f = ""
+		}
+		args = append(args, []byte(f))
+	}
+	return strings.ToUpper(fields[0]), args
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		keys string
+	}{
+		{"GET k", "k"},
+		{"SET k v EX 10", "k"},
+		{"MGET a b c", "a b c"},
+		{"MSET a 1 b 2", "a b"},
+		{"OBJECT ENCODING k", "k"},
+		{"PING", ""},
+		// numkeys
+		{"EVAL s 2 k1 k2 a1", "k1 k2"},
+		{"EVALSHA s 0 a1", ""},
+		{"EVAL s 3 k1", ""},
+		{"EVAL s x k1", ""},
+		{"ZUNIONSTORE dst 2 a b WEIGHTS 1 2", "dst a b"},
+		{"ZINTER 2 a b", "a b"},
+		{"LMPOP 2 a b LEFT", "a b"},
+		{"BLMPOP 0 2 a b LEFT", "a b"},
+		// streams
+		{"XREAD COUNT 2 STREAMS s1 s2 0 0", "s1 s2"},
+		{"XREAD BLOCK 0 streams s 0", "s"},
+		{"XREAD STREAMS s1", ""},
+		{"XREADGROUP GROUP g c BLOCK 0 STREAMS s $", "s"},
+		// movable keys
+		{"MIGRATE h 6379 k 0 1000", "k"},
+		{`MIGRATE h 6379 "" 0 1000 KEYS a b`, "a b"},
+		{"SORT k BY w STORE dst", "k dst"},
+		{"GEORADIUS k 0 0 1 m STOREDIST d", "k d"},
+	}
+	for _, test := range tests {
+		name, args := testArgs(test.cmd)
+		var keys []string
+		for _, key := range lookupCommand(name).keys(args) {
+			keys = append(keys, string(key))
+		}
+		if got := strings.Join(keys, " "); got != test.keys {
+			t.Errorf("%s: got keys %q, want %q", test.cmd, got, test.keys)
+		}
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		blocks  bool
+		timeout time.Duration
+	}{
+		{"BLPOP a b 1.5", true, 1500 * time.Millisecond},
+		{"BRPOP a 0", true, 0},
+		{"BLPOP a x", true, 0},
+		{"BRPOPLPUSH a b 3", true, 3 * time.Second},
+		{"BLMOVE a b LEFT RIGHT 2", true, 2 * time.Second},
+		{"BLMPOP 0.5 2 a b LEFT", true, 500 * time.Millisecond},
+		{"BZMPOP 1 1 z MIN", true, time.Second},
+		{"XREAD BLOCK 100 STREAMS s 0", true, 100 * time.Millisecond},
+		{"XREADGROUP GROUP g c block 0 STREAMS s >", true, 0},
+		{"XREAD STREAMS s 0", false, 0},
+		{"GET a", false, 0},
+	}
+	for _, test := range tests {
+		name, args := testArgs(test.cmd)
+		c := lookupCommand(name)
+		if blocks := c.blocks(args); blocks != test.blocks {
+			t.Errorf("%s: blocks %v, want %v", test.cmd, blocks, test.blocks)
+		}
+		if !test.blocks {
+			continue
+		}
+		if timeout := c.blockTimeout(args); timeout != test.timeout {
+			t.Errorf("%s: got timeout %v, want %v", test.cmd, timeout, test.timeout)
+		}
+	}
+}
+
+func TestRefreshCommandTable(t *testing.T) {
+	commandLock.RLock()
+	base, table := baseTable, commandTable
+	commandLock.RUnlock()
+	defer func() {
+		commandLock.Lock()
+		baseTable, commandTable = base, table
+		commandLock.Unlock()
+	}()
+
+	entry := func(name string, arity int64, flags []interface{}, first, last, step int64) interface{} {
+		return []interface{}{[]byte(name), arity, flags, first, last, step}
+	}
+	reply := []interface{}{
+		entry("get", 2, []interface{}{"readonly", "fast"}, 1, 1, 1),
+		// container commands report no key, positions of the table are kept
+		entry("object", -2, []interface{}{"readonly"}, 0, 0, 0),
+		// denied commands stay denied
+		entry("echo", 2, []interface{}{"fast"}, 0, 0, 0),
+		entry("newread", -2, []interface{}{"readonly"}, 1, -1, 1),
+		entry("newadmin", 1, []interface{}{"admin"}, 0, 0, 0),
+		entry("newblock", 3, []interface{}{"write", "blocking"}, 1, 1, 1),
+		entry("newmovable", -3, []interface{}{"write", "movablekeys"}, 0, 0, 0),
+	}
+	n, err := refreshCommandTable(reply)
+	if err != nil || n != len(reply) {
+		t.Fatalf("got %d, %v", n, err)
+	}
+
+	tests := []struct {
+		cmd    string
+		keys   string
+		flags  int
+		denied bool
+	}{
+		{"GET k", "k", CmdReadonly, false},
+		{"OBJECT ENCODING k", "k", CmdReadonly, false},
+		{"ECHO x", "", 0, true},
+		{"NEWREAD a b", "a b", CmdReadonly, false},
+		{"NEWADMIN", "", CmdAdmin, true},
+		{"NEWBLOCK k 0", "k", CmdWrite | CmdBlocking, true},
+		{"NEWMOVABLE a b", "", CmdWrite | CmdMovableKeys, true},
+		// commands not in the reply are kept
+		{"SET k v", "k", CmdWrite, false},
+	}
+	for _, test := range tests {
+		name, args := testArgs(test.cmd)
+		c := lookupCommand(name)
+		if c == nil {
+			t.Errorf("%s: not in the table", test.cmd)
+			continue
+		}
+		var keys []string
+		for _, key := range c.keys(args) {
+			keys = append(keys, string(key))
+		}
+		if got := strings.Join(keys, " "); got != test.keys {
+			t.Errorf("%s: got keys %q, want %q", test.cmd, got, test.keys)
+		}
+		if flags := c.flags &^ CmdDeny; flags&test.flags != test.flags {
+			t.Errorf("%s: got flags %b, want %b", test.cmd, flags, test.flags)
+		}
+		if denied := c.flags&CmdDeny != 0; denied != test.denied {
+			t.Errorf("%s: denied %v, want %v", test.cmd, denied, test.denied)
+		}
+	}
+
+	for _, bad := range []interface{}{
+		[]byte("OK"),
+		[]interface{}{[]interface{}{[]byte("get"), int64(2)}},
+		[]interface{}{[]interface{}{[]byte("get"), []byte("2"), []interface{}{}, int64(1), int64(1), int64(1)}},
+	} {
+		if _, err := refreshCommandTable(bad); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
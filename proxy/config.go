@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Config of proxy, loaded from a TOML file, timeouts are in millisecond
+type Config struct {
+	// address the proxy listen on
+	Listen string `toml:"listen"`
+	// nodes of cluster, tried in turn when proxy starts
+	Seeds []string `toml:"seeds"`
+	// number of connections to each node
+	PoolSize     int `toml:"pool_size"`
+	DialTimeout  int `toml:"dial_timeout"`
+	ReadTimeout  int `toml:"read_timeout"`
+	WriteTimeout int `toml:"write_timeout"`
+	// how long shutdown waits for sessions to finish in-flight requests
+	DrainTimeout int `toml:"drain_timeout"`
+	// which node serves read-only commands: master, prefer-replica,
+	// round-robin or lowest-latency
+	ReadPolicy string `toml:"read_policy"`
+	// FLUSHALL and FLUSHDB wipe all masters, disabled by default
+	AllowFlushAll bool `toml:"allow_flushall"`
+	// commands allowed though denied by default, and commands denied though supported
+	AllowCommands []string `toml:"allow_commands"`
+	DenyCommands  []string `toml:"deny_commands"`
+	// address of prometheus /metrics endpoint, disabled if empty
+	Metrics string `toml:"metrics"`
+	// credentials sent by AUTH on every connection to nodes, user is empty for requirepass
+	BackendUser     string `toml:"backend_user"`
+	BackendPassword string `toml:"backend_password"`
+	// TLS of client listener and connections to nodes
+	TLS        TLSConfig `toml:"tls"`
+	BackendTLS TLSConfig `toml:"backend_tls"`
+	// password of the default user, clients must AUTH if it's set or users are defined
+	Password  string       `toml:"password"`
+	Users     []UserConfig `toml:"users"`
+	Dashboard string       `toml:"dashboard"`
+	// limits of requests per second
+	RateLimit RateLimitConfig `toml:"rate_limit"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:       ":7011",
+		Seeds:        []string{"127.0.0.1:7101"},
+		PoolSize:     BACKENSIZE,
+		DialTimeout:  1000,
+		ReadTimeout:  3000,
+		WriteTimeout: 3000,
+		DrainTimeout: 10000,
+		ReadPolicy:   ReadMaster,
+		Metrics:      "",
+		Dashboard:    "",
+	}
+}
+
+// LoadConfig read config file, options not in the file keep their default values
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table, err := parseToml(string(data))
+	if err != nil {
+		return nil, err
+	}
+	conf := DefaultConfig()
+	if err := decodeToml(table, reflect.ValueOf(conf).Elem()); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Check validate config after it's loaded and overridden by command line flags
+func (conf *Config) Check() error {
+	switch {
+	case len(conf.Seeds) == 0:
+		return protocolError("config: no seed node")
+	case conf.PoolSize <= 0:
+		return protocolError("config: pool_size should be positive")
+	case conf.DialTimeout < 0 || conf.ReadTimeout < 0 || conf.WriteTimeout < 0 || conf.DrainTimeout < 0:
+		return protocolError("config: timeout should not be negative")
+	case !validReadPolicy(conf.ReadPolicy):
+		return protocolError("config: unknown read_policy " + conf.ReadPolicy)
+	case conf.BackendUser != "" && conf.BackendPassword == "":
+		return protocolError("config: backend_user without backend_password")
+	case conf.TLS.Enabled && (conf.TLS.Cert == "" || conf.TLS.Key == ""):
+		return protocolError("config: tls needs cert and key")
+	case (conf.BackendTLS.Cert == "") != (conf.BackendTLS.Key == ""):
+		return protocolError("config: backend_tls needs both cert and key")
+	case !conf.RateLimit.valid():
+		return protocolError("config: rate_limit should not be negative")
+	}
+	denied := make(map[string]bool)
+	for _, name := range conf.DenyCommands {
+		denied[strings.ToUpper(name)] = true
+	}
+	for _, name := range conf.AllowCommands {
+		if denied[strings.ToUpper(name)] {
+			return protocolError("config: " + name + " is in both allow_commands and deny_commands")
+		}
+	}
+	_, err := newACL(conf)
+	return err
+}
+
+func (conf *Config) dialTimeout() time.Duration {
+	return time.Duration(conf.DialTimeout) * time.Millisecond
+}
+
+// pingTimeout is how long a PING queued behind requests may take, as long as a
+// request may be written and replied, KEEPALIVE if requests have no timeout
+func (conf *Config) pingTimeout() time.Duration {
+	if conf.ReadTimeout == 0 || conf.WriteTimeout == 0 {
+		return KEEPALIVE
+	}
+	return time.Duration(conf.ReadTimeout+conf.WriteTimeout) * time.Millisecond
+}
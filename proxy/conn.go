@@ -16,12 +16,24 @@ type RedisConn interface {
 	writeCmd(string) error
 	// write raw bytes
 	writeBytes([]byte) error
+	// write raw bytes to buffer without flush
+	write([]byte) error
+	flush() error
 	// get response remote
 	readReply() (interface{}, error)
+	// read a reply as it is without decoding it
+	readRaw() ([]byte, error)
+	// read a reply, a long bulk string is left to be read by readChunk
+	readRawHead(int64) ([]byte, int64, error)
+	readChunk([]byte) error
+	// read a request of client, args are sliced from the raw request
+	readRequest(bool) ([]byte, [][]byte, error)
 	remoteAddr() string
 	ping() error
 	clear() error
 	close() error
+	// fail reads but keep writing
+	stopRead() error
 }
 
 // NewConn returns a new connection.
@@ -31,7 +43,7 @@ func NewConn(netConn net.Conn, readTimeout, writeTimeout int64) RedisConn {
 		bw:           bufio.NewWriter(netConn),
 		br:           bufio.NewReader(netConn),
 		readTimeout:  time.Duration(readTimeout) * time.Millisecond,
-		writeTimeout: time.Duration(readTimeout) * time.Millisecond,
+		writeTimeout: time.Duration(writeTimeout) * time.Millisecond,
 		response:     bytes.NewBuffer(nil),
 	}
 }
@@ -48,7 +60,13 @@ type redisConn struct {
 func (c *redisConn) readLine() ([]byte, error) {
 	p, err := c.br.ReadSlice('\n')
 	if err == bufio.ErrBufferFull {
-		return nil, protocolError("response longer that buffer")
+		// the line is longer than the read buffer, copy it out in chunks
+		long := append([]byte(nil), p...)
+		for err == bufio.ErrBufferFull {
+			p, err = c.br.ReadSlice('\n')
+			long = append(long, p...)
+		}
+		p = long
 	}
 	if err != nil {
 		return nil, err
@@ -62,6 +80,9 @@ func (c *redisConn) readLine() ([]byte, error) {
 }
 
 func (c *redisConn) readLen(len int64) ([]byte, error) {
+	if len > MAXBULKSIZE {
+		return nil, protocolError("invalid bulk length")
+	}
 	p := make([]byte, len)
 	_, err := io.ReadFull(c.br, p)
 	c.bufferResponse(p)
@@ -108,7 +129,15 @@ func parseInt(p []byte) (int64, error) {
 	return n, nil
 }
 
+// readReply read a whole reply, the read timeout applies to each reply
 func (c *redisConn) readReply() (interface{}, error) {
+	if c.readTimeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.readValue()
+}
+
+func (c *redisConn) readValue() (interface{}, error) {
 	line, err := c.readLine()
 	if err != nil {
 		return nil, err
@@ -116,7 +145,9 @@ func (c *redisConn) readReply() (interface{}, error) {
 	if len(line) == 0 {
 		return nil, protocolError("short response line")
 	}
-	switch line[0] {
+	// line is overwritten by following reads
+	kind := line[0]
+	switch kind {
 	case '+':
 		switch {
 		case len(line) == 3 && line[1] == 'O' && line[2] == 'K':
@@ -127,25 +158,7 @@ func (c *redisConn) readReply() (interface{}, error) {
 			return string(line[1:]), nil
 		}
 	case '-':
-		lineArr := splitRegex.Split(string(line), 4)
-		switch {
-		// MOVED 1180 127.0.0.1:7101
-		case len(lineArr) == 3 && lineArr[0] == "-MOVED":
-			slot, err := strconv.ParseInt(lineArr[1], 10, 64)
-			if err != nil {
-				return nil, protocolError("MOVED error parse slot failed: " + err.Error())
-			}
-			return nil, &movedError{Slot: slot, Address: lineArr[2]}
-		// ASK
-		case len(lineArr) == 3 && lineArr[0] == "-ASK":
-			slot, err := strconv.ParseInt(lineArr[1], 10, 64)
-			if err != nil {
-				return nil, protocolError("ASK error parse slot failed: " + err.Error())
-			}
-			return nil, &askError{Slot: slot, Address: lineArr[2]}
-		default:
-			return nil, protocolError(string(line[1:]))
-		}
+		return nil, parseError(line)
 	case ':':
 		return parseInt(line[1:])
 	case '$':
@@ -168,18 +181,336 @@ func (c *redisConn) readReply() (interface{}, error) {
 		if n < 0 || err != nil {
 			return nil, err
 		}
-		r := make([]interface{}, n)
-		for i := range r {
-			r[i], err = c.readReply()
-			if err != nil {
-				return nil, err
-			}
+		return c.readElements(n)
+	// RESP3 types
+	case '_':
+		return nil, nil
+	case '#':
+		if len(line) != 2 || (line[1] != 't' && line[1] != 'f') {
+			return nil, protocolError("bad boolean format")
+		}
+		return line[1] == 't', nil
+	case ',':
+		return respDouble(line[1:]), nil
+	case '(':
+		return respBigNumber(line[1:]), nil
+	case '=', '!':
+		n, err := parseInt(line[1:])
+		if n < 0 || err != nil {
+			return nil, protocolError("bad blob length")
+		}
+		p, err := c.readLen(n)
+		if err != nil {
+			return nil, err
 		}
-		return r, nil
+		if line, err := c.readLine(); err != nil {
+			return nil, err
+		} else if len(line) != 0 {
+			return nil, protocolError("bad blob format")
+		}
+		if kind == '!' {
+			return nil, redisError(p)
+		}
+		// verbatim string starts with its format like `txt:`
+		if len(p) < 4 || p[3] != ':' {
+			return nil, protocolError("bad verbatim string format")
+		}
+		return p[4:], nil
+	case '%', '~', '>', '|':
+		n, err := parseInt(line[1:])
+		if n < 0 || err != nil {
+			return nil, protocolError("bad aggregate length")
+		}
+		if kind == '%' || kind == '|' {
+			n *= 2
+		}
+		r, err := c.readElements(n)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case '%':
+			return respMap(r), nil
+		case '~':
+			return respSet(r), nil
+		case '>':
+			return respPush(r), nil
+		}
+		// attributes are kept in the raw response, the value follows them
+		return c.readValue()
 	}
 	return nil, protocolError("unexpected response line")
 }
 
+// readElements read n values of an aggregate
+func (c *redisConn) readElements(n int64) ([]interface{}, error) {
+	r := make([]interface{}, n)
+	for i := range r {
+		var err error
+		r[i], err = c.readValue()
+		// an error element like in reply of EXEC doesn't fail the array
+		if isReplyError(err) {
+			r[i] = err
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseError parse an error line, redirections are parsed for retrying
+func parseError(line []byte) error {
+	lineArr := splitRegex.Split(string(line), 4)
+	switch {
+	// MOVED 1180 127.0.0.1:7101
+	case len(lineArr) == 3 && lineArr[0] == "-MOVED":
+		slot, err := strconv.ParseInt(lineArr[1], 10, 64)
+		if err != nil {
+			return protocolError("MOVED error parse slot failed: " + err.Error())
+		}
+		return &movedError{Slot: slot, Address: lineArr[2]}
+	// ASK
+	case len(lineArr) == 3 && lineArr[0] == "-ASK":
+		slot, err := strconv.ParseInt(lineArr[1], 10, 64)
+		if err != nil {
+			return protocolError("ASK error parse slot failed: " + err.Error())
+		}
+		return &askError{Slot: slot, Address: lineArr[2]}
+	}
+	return redisError(string(line[1:]))
+}
+
+// MAXBULKSIZE is the max length of a bulk string, like proto-max-bulk-len of redis
+const MAXBULKSIZE = 512 * 1024 * 1024
+
+// readRaw read a whole reply as it is, values are copied once into the returned
+// bytes instead of being decoded. An error reply is returned with its error
+func (c *redisConn) readRaw() ([]byte, error) {
+	if c.readTimeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.scanValue(nil)
+}
+
+// readRawHead read a reply like readRaw, except a bulk string of at least stream
+// bytes, only its head line is read and the number of bytes left, including the
+// terminator, is returned. They must be read by readChunk
+func (c *redisConn) readRawHead(stream int64) ([]byte, int64, error) {
+	if c.readTimeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	raw, line, err := c.appendLine(nil)
+	if err != nil {
+		return raw, 0, err
+	}
+	if line[0] == '$' {
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return raw, 0, err
+		}
+		if n > MAXBULKSIZE {
+			return raw, 0, protocolError("invalid bulk length")
+		}
+		if n >= stream {
+			return raw, n + 2, nil
+		}
+	}
+	raw, err = c.scanBody(raw, line)
+	return raw, 0, err
+}
+
+// readChunk fill p with the rest of a reply left by readRawHead
+func (c *redisConn) readChunk(p []byte) error {
+	if c.readTimeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	_, err := io.ReadFull(c.br, p)
+	return err
+}
+
+// limits of requests before the client authenticates, like redis
+const (
+	UNAUTHMULTIBULK = 10
+	UNAUTHBULK      = 16384
+)
+
+// readRequest read a request of client. A request is an array of bulk strings,
+// args are sliced from raw without copying. args is empty if the request isn't
+// an array, an arg is nil if it isn't a bulk string. Requests of clients not
+// authenticated yet are limited in size
+func (c *redisConn) readRequest(unauthenticated bool) ([]byte, [][]byte, error) {
+	if c.readTimeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	raw, line, err := c.appendLine(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if line[0] != '*' {
+		raw, err = c.scanBody(raw, line)
+		return raw, nil, err
+	}
+	n, err := parseInt(line[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if unauthenticated && n > UNAUTHMULTIBULK {
+		return nil, nil, protocolError("unauthenticated multibulk length")
+	}
+	// offsets of args in raw, which moves while it grows
+	type span struct{ start, end int }
+	spans := make([]span, 0, 8)
+	for i := int64(0); i < n; i++ {
+		if raw, line, err = c.appendLine(raw); err != nil {
+			return nil, nil, err
+		}
+		if line[0] != '$' {
+			if raw, err = c.scanBody(raw, line); err != nil && !isReplyError(err) {
+				return nil, nil, err
+			}
+			spans = append(spans, span{-1, -1})
+			continue
+		}
+		size, err := parseInt(line[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if size < 0 {
+			spans = append(spans, span{-1, -1})
+			continue
+		}
+		if unauthenticated && size > UNAUTHBULK {
+			return nil, nil, protocolError("unauthenticated bulk length")
+		}
+		start := len(raw)
+		if raw, err = c.appendLen(raw, size); err != nil {
+			return nil, nil, err
+		}
+		spans = append(spans, span{start, start + int(size)})
+	}
+	args := make([][]byte, len(spans))
+	for i, s := range spans {
+		if s.start >= 0 {
+			args[i] = raw[s.start:s.end:s.end]
+		}
+	}
+	return raw, args, nil
+}
+
+// scanValue append a raw value to out
+func (c *redisConn) scanValue(out []byte) ([]byte, error) {
+	out, line, err := c.appendLine(out)
+	if err != nil {
+		return out, err
+	}
+	return c.scanBody(out, line)
+}
+
+// scanBody append the rest of a raw value to out, line is its first line which
+// is already in out
+func (c *redisConn) scanBody(out []byte, line []byte) ([]byte, error) {
+	kind := line[0]
+	switch kind {
+	case '+', ':', '_', '#', ',', '(':
+		return out, nil
+	case '-':
+		return out, parseError(line)
+	case '$', '=', '!':
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return out, err
+		}
+		if n < 0 {
+			if kind != '$' {
+				return out, protocolError("bad blob length")
+			}
+			return out, nil
+		}
+		if out, err = c.appendLen(out, n); err != nil {
+			return out, err
+		}
+		if kind == '!' {
+			return out, redisError(out[len(out)-int(n)-2 : len(out)-2])
+		}
+		return out, nil
+	case '*', '%', '~', '>', '|':
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return out, err
+		}
+		if kind == '%' || kind == '|' {
+			n *= 2
+		}
+		// the value follows its attributes
+		if kind == '|' {
+			n++
+		}
+		for ; n > 0; n-- {
+			// an error element like in reply of EXEC doesn't fail the aggregate
+			if out, err = c.scanValue(out); err != nil && !isReplyError(err) {
+				return out, err
+			}
+		}
+		return out, nil
+	}
+	return out, protocolError("unexpected response line")
+}
+
+// appendLine append a line to out, the appended line is returned without its
+// terminator. Lines longer than the read buffer are read in chunks
+func (c *redisConn) appendLine(out []byte) ([]byte, []byte, error) {
+	start := len(out)
+	for {
+		p, err := c.br.ReadSlice('\n')
+		out = append(out, p...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return out, nil, err
+		}
+		break
+	}
+	i := len(out) - 2
+	if i < start || out[i] != '\r' {
+		return out, nil, protocolError("bad response length or line terminator")
+	}
+	if i == start {
+		return out, nil, protocolError("short response line")
+	}
+	return out, out[start:i], nil
+}
+
+// appendLen append a blob of n bytes and its terminator to out, it's read into
+// out directly. out grows as data arrives, a length announced without data
+// allocates nothing
+func (c *redisConn) appendLen(out []byte, n int64) ([]byte, error) {
+	if n > MAXBULKSIZE {
+		return out, protocolError("invalid bulk length")
+	}
+	for left := int(n) + 2; left > 0; {
+		size := left
+		if size > STREAMCHUNK {
+			size = STREAMCHUNK
+		}
+		start := len(out)
+		if start+size > cap(out) {
+			grown := make([]byte, start, 2*cap(out)+size)
+			copy(grown, out)
+			out = grown
+		}
+		out = out[:start+size]
+		if _, err := io.ReadFull(c.br, out[start:]); err != nil {
+			return out[:start], err
+		}
+		left -= size
+	}
+	if end := len(out); out[end-2] != '\r' || out[end-1] != '\n' {
+		return out, protocolError("bad bulk string format")
+	}
+	return out, nil
+}
+
 func (c *redisConn) writeCmd(cmd string) error {
 	cmdArr := splitRegex.Split(cmd, 99)
 	cmdStr := fmt.Sprintf("*%d\r\n", len(cmdArr))
@@ -192,6 +523,18 @@ func (c *redisConn) writeCmd(cmd string) error {
 
 func (c *redisConn) writeBytes(cmd []byte) error {
 	c.bw.Write(cmd)
+	return c.flush()
+}
+
+func (c *redisConn) write(cmd []byte) error {
+	_, err := c.bw.Write(cmd)
+	return err
+}
+
+func (c *redisConn) flush() error {
+	if c.writeTimeout != 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
 	if err := c.bw.Flush(); err != nil {
 		return protocolError("flush error")
 	}
@@ -238,8 +581,103 @@ func (c *redisConn) close() error {
 	return c.conn.Close()
 }
 
+// stopRead fail the pending read and reads from now on, replies can still be
+// written. It's for conns without read timeout, which would reset the deadline
+func (c *redisConn) stopRead() error {
+	return c.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// protocol versions negotiated by HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// RESP3 aggregates, map has keys and values interleaved
+type (
+	respMap  []interface{}
+	respSet  []interface{}
+	respPush []interface{}
+)
+
+// RESP3 numbers are kept as they are in the reply
+type (
+	respDouble    string
+	respBigNumber string
+)
+
 var (
 	okReply    interface{}    = "OK"
 	pongReply  interface{}    = "PONG"
 	splitRegex *regexp.Regexp = regexp.MustCompile(" +")
 )
+
+// encodeCmd build a RESP array of bulk strings from arguments
+func encodeCmd(args [][]byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n", len(arg))
+		buf.Write(arg)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// encodeReply is the reverse of readReply, it serializes a parsed reply back to RESP
+func encodeReply(reply interface{}) []byte {
+	buf := bytes.NewBuffer(nil)
+	writeReply(buf, reply)
+	return buf.Bytes()
+}
+
+func writeReply(buf *bytes.Buffer, reply interface{}) {
+	switch val := reply.(type) {
+	case nil:
+		buf.WriteString("$-1\r\n")
+	case string:
+		buf.WriteString("+" + val + "\r\n")
+	case int64:
+		buf.WriteString(":" + strconv.FormatInt(val, 10) + "\r\n")
+	case []byte:
+		fmt.Fprintf(buf, "$%d\r\n", len(val))
+		buf.Write(val)
+		buf.WriteString("\r\n")
+	case []interface{}:
+		writeAggregate(buf, '*', len(val), val)
+	case respMap:
+		writeAggregate(buf, '%', len(val)/2, val)
+	case respSet:
+		writeAggregate(buf, '~', len(val), val)
+	case respPush:
+		writeAggregate(buf, '>', len(val), val)
+	case bool:
+		if val {
+			buf.WriteString("#t\r\n")
+		} else {
+			buf.WriteString("#f\r\n")
+		}
+	case respDouble:
+		buf.WriteString("," + string(val) + "\r\n")
+	case respBigNumber:
+		buf.WriteString("(" + string(val) + "\r\n")
+	case error:
+		buf.WriteString("-" + val.Error() + "\r\n")
+	}
+}
+
+func writeAggregate(buf *bytes.Buffer, kind byte, n int, elems []interface{}) {
+	fmt.Fprintf(buf, "%c%d\r\n", kind, n)
+	for _, v := range elems {
+		writeReply(buf, v)
+	}
+}
+
+// parseReply parse a raw response returned by proxy.slotDo
+func parseReply(resp []byte) (interface{}, error) {
+	c := &redisConn{
+		br:       bufio.NewReader(bytes.NewReader(resp)),
+		response: bytes.NewBuffer(nil),
+	}
+	return c.readValue()
+}
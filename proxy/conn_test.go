@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testConn return a conn reading data, the peer is closed once data is read
+func testConn(data string) RedisConn {
+	client, server := net.Pipe()
+	go func() {
+		server.Write([]byte(data))
+		server.Close()
+	}()
+	return NewConn(client, 0, 0)
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		in string
+		// nil args are marked by "<nil>"
+		args []string
+		err  string
+	}{
+		{in: "*1\r\n$4\r\nPING\r\n", args: []string{"PING"}},
+		{in: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n", args: []string{"SET", "k", ""}},
+		{in: "*2\r\n$3\r\nGET\r\n$-1\r\n", args: []string{"GET", "<nil>"}},
+		{in: "*2\r\n$3\r\nGET\r\n:1\r\n", args: []string{"GET", "<nil>"}},
+		{in: "*0\r\n", args: []string{}},
+		{in: "+OK\r\n", args: []string{}},
+		{in: "*1\r\n$4\r\nPINGxx", err: "bad bulk string format"},
+		{in: "*1\r\n$x\r\n", err: "illegal bytes in length"},
+		{in: "*1\r\n$4\r\nPI", err: "EOF"},
+		{in: "*1\r\n$600000000\r\n", err: "invalid bulk length"},
+	}
+	for _, test := range tests {
+		raw, args, err := testConn(test.in).readRequest(false)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if string(raw) != test.in {
+			t.Errorf("%q: got raw %q", test.in, raw)
+		}
+		got := make([]string, len(args))
+		for i, arg := range args {
+			got[i] = string(arg)
+			if arg == nil {
+				got[i] = "<nil>"
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(test.args, ",") || len(got) != len(test.args) {
+			t.Errorf("%q: got args %q, want %q", test.in, got, test.args)
+		}
+	}
+}
+
+func TestReadRequestUnauthenticated(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"*3\r\n$4\r\nAUTH\r\n$3\r\napp\r\n$6\r\nsecret\r\n", ""},
+		{"*11\r\n", "unauthenticated multibulk length"},
+		{"*2\r\n$3\r\nSET\r\n$16385\r\n", "unauthenticated bulk length"},
+	}
+	for _, test := range tests {
+		_, _, err := testConn(test.in).readRequest(true)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: got error %v, want %q", test.in, err, test.err)
+		}
+	}
+}
+
+func TestReadRequestLargeBulk(t *testing.T) {
+	// args sliced from raw survive its growth
+	value := strings.Repeat("v", 3*STREAMCHUNK+5)
+	in := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	_, args, err := testConn(in).readRequest(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 3 || string(args[0]) != "SET" || string(args[1]) != "k" || string(args[2]) != value {
+		t.Fatal("bad args of large request")
+	}
+
+	// an announced length without data allocates nothing up front
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, _, err := testConn("*1\r\n$400000000\r\n").readRequest(false); err == nil {
+		t.Fatal("truncated request is read")
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Errorf("%d bytes allocated for a truncated request", grown)
+	}
+}
+
+func TestReadReplyResp3(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+		err  string
+	}{
+		{in: "_\r\n", want: nil},
+		{in: "#t\r\n", want: true},
+		{in: "#f\r\n", want: false},
+		{in: "#x\r\n", err: "bad boolean format"},
+		{in: ",3.14\r\n", want: respDouble("3.14")},
+		{in: ",inf\r\n", want: respDouble("inf")},
+		{in: "(3492890328409238509324850943850943825024385\r\n", want: respBigNumber("3492890328409238509324850943850943825024385")},
+		{in: "=15\r\ntxt:Some string\r\n", want: []byte("Some string")},
+		{in: "=3\r\ntxt\r\n", err: "bad verbatim string format"},
+		{in: "!21\r\nSYNTAX invalid syntax\r\n", err: "SYNTAX invalid syntax"},
+		{in: "%2\r\n+first\r\n:1\r\n$6\r\nsecond\r\n_\r\n",
+			want: respMap{"first", int64(1), []byte("second"), nil}},
+		{in: "~2\r\n:1\r\n#t\r\n", want: respSet{int64(1), true}},
+		{in: ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n",
+			want: respPush{[]byte("message"), []byte("ch"), []byte("hi")}},
+		// attributes are skipped, the value follows them
+		{in: "|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n*1\r\n:2\r\n", want: []interface{}{int64(2)}},
+		{in: "*2\r\n%1\r\n+k\r\n~1\r\n_\r\n,1e3\r\n",
+			want: []interface{}{respMap{"k", respSet{nil}}, respDouble("1e3")}},
+		{in: "%-1\r\n", err: "bad aggregate length"},
+		{in: "=-1\r\n", err: "bad blob length"},
+	}
+	for _, test := range tests {
+		got, err := testConn(test.in).readReply()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.in, got, test.want)
+		}
+		// replies are forwarded to clients as they are
+		if raw, err := testConn(test.in).readRaw(); err != nil || string(raw) != test.in {
+			t.Errorf("%q: read raw %q, %v", test.in, raw, err)
+		}
+	}
+}
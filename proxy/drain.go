@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DRAININTERVAL is how often draining checks sessions
+const DRAININTERVAL = 100 * time.Millisecond
+
+// DrainSessions stop reading from clients once their sessions have no request in
+// flight, sessions still busy when timeout expires are closed anyway. It returns
+// after every session has finished, the listener should be closed before
+func DrainSessions(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		list := liveSessions()
+		if len(list) == 0 {
+			return
+		}
+		expired := time.Now().After(deadline)
+		for _, sess := range list {
+			switch {
+			case expired:
+				sess.cliConn.close()
+			case sess.idle():
+				// only the reader is stopped, a request read after idle is
+				// checked is still replied before the session closes itself
+				sess.cliConn.stopRead()
+			}
+		}
+		time.Sleep(DRAININTERVAL)
+	}
+}
+
+// idle tell if all requests read from client are replied and no message is
+// waiting to be written
+func (sess *session) idle() bool {
+	return atomic.LoadInt64(&sess.unreplied) == 0
+}
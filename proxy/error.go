@@ -10,6 +10,43 @@ func (pe protocolError) Error() string {
 	return fmt.Sprintf("proxy: %s", string(pe))
 }
 
+// redisError is an error reply from redis, forwarded to client as it is
+type redisError string
+
+func (re redisError) Error() string {
+	return string(re)
+}
+
+// clusterDownError is returned when the node of a slot is unreachable,
+// clients see it like the CLUSTERDOWN error of redis
+type clusterDownError string
+
+func (ce clusterDownError) Error() string {
+	if ce == "" {
+		return "CLUSTERDOWN Hash slot not served"
+	}
+	return fmt.Sprintf("CLUSTERDOWN node %s is unreachable", string(ce))
+}
+
+// authError is returned when a node rejects credentials of proxy, reconnecting
+// doesn't help until the config is fixed
+type authError struct {
+	Address string
+	Reason  string
+}
+
+func (ae *authError) Error() string {
+	return fmt.Sprintf("proxy: authentication to node %s failed, %s", ae.Address, ae.Reason)
+}
+
+// dialError is the error replied to client when a connection to addr can't be dialed
+func dialError(addr string, err error) error {
+	if ae, ok := err.(*authError); ok {
+		return ae
+	}
+	return clusterDownError(addr)
+}
+
 type movedError struct {
 	Slot    int64
 	Address string
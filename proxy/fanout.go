@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// fanoutCmds are keyless commands about the whole dataset, run on masters
+var fanoutCmds = map[string]bool{
+	"DBSIZE":    true,
+	"INFO":      true,
+	"KEYS":      true,
+	"FLUSHALL":  true,
+	"FLUSHDB":   true,
+	"RANDOMKEY": true,
+	"TIME":      true,
+}
+
+// fanoutDo broadcast cmd to all masters and merge replies, RANDOMKEY and TIME
+// go to one master
+func (p *proxy) fanoutDo(cmd string, args [][]byte) ([]byte, error) {
+	raw := encodeCmd(append([][]byte{[]byte(cmd)}, args...))
+	switch cmd {
+	case "FLUSHALL", "FLUSHDB":
+		if !p.config().AllowFlushAll {
+			return nil, protocolError(cmd + " is disabled, set allow_flushall to enable it")
+		}
+	case "TIME":
+		return p.randomMasterDo(raw)
+	case "RANDOMKEY":
+		return p.randomKey(raw)
+	case "INFO":
+		if len(args) == 1 && strings.ToLower(string(args[0])) == "proxy" {
+			return encodeReply(p.proxyInfo()), nil
+		}
+	}
+
+	addrs := p.masters()
+	replies, err := p.broadcastTo(addrs, raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) == 0 {
+		return nil, clusterDownError("")
+	}
+
+	switch cmd {
+	case "DBSIZE":
+		var sum int64
+		for _, reply := range replies {
+			n, ok := reply.(int64)
+			if !ok {
+				return nil, protocolError("bad DBSIZE reply from backend")
+			}
+			sum += n
+		}
+		return encodeReply(sum), nil
+	case "KEYS":
+		keys := make([]interface{}, 0)
+		for _, reply := range replies {
+			values, ok := reply.([]interface{})
+			if !ok {
+				return nil, protocolError("bad KEYS reply from backend")
+			}
+			keys = append(keys, values...)
+		}
+		return encodeReply(keys), nil
+	case "INFO":
+		infos := make([][]byte, len(replies))
+		for i, reply := range replies {
+			info, ok := reply.([]byte)
+			if !ok {
+				return nil, protocolError("bad INFO reply from backend")
+			}
+			infos[i] = info
+		}
+		info := mergeInfo(addrs, infos)
+		if len(args) == 0 || strings.ToLower(string(args[0])) == "all" || strings.ToLower(string(args[0])) == "everything" {
+			info = append(append(info, "\r\n"...), p.proxyInfo()...)
+		}
+		return encodeReply(info), nil
+	default:
+		// FLUSHALL, FLUSHDB
+		return encodeReply(okReply), nil
+	}
+}
+
+// randomMasterDo send cmd to a random master
+func (p *proxy) randomMasterDo(cmd []byte) ([]byte, error) {
+	addrs := p.masters()
+	if len(addrs) == 0 {
+		return nil, clusterDownError("")
+	}
+	return p.execNoAsk(cmd, addrs[rand.Intn(len(addrs))], 0)
+}
+
+// randomKey try masters in random order until one has a key
+func (p *proxy) randomKey(cmd []byte) ([]byte, error) {
+	addrs := p.masters()
+	var resp []byte
+	var err error
+	for _, i := range rand.Perm(len(addrs)) {
+		resp, err = p.execNoAsk(cmd, addrs[i], 0)
+		if err != nil {
+			return nil, err
+		}
+		if reply, _ := parseReply(resp); reply != nil {
+			return resp, nil
+		}
+	}
+	if resp == nil {
+		return nil, clusterDownError("")
+	}
+	return resp, nil
+}
+
+// infoSection is a section of INFO reply, fields are in order
+type infoSection struct {
+	name   string
+	keys   []string
+	values map[string][]string
+}
+
+// summableSections are INFO sections of counters, which are summed when merged
+var summableSections = map[string]bool{
+	"Clients":      true,
+	"Memory":       true,
+	"Stats":        true,
+	"Keyspace":     true,
+	"Commandstats": true,
+	"Errorstats":   true,
+}
+
+// mergeInfo merge INFO of nodes section by section. Integer fields of counter
+// sections are summed, like keys=1,expires=0 of keyspace, usec_per_call of
+// commandstats is computed again from the sums. Other fields take the value of the
+// first node. A Nodes section breaks down main numbers by node
+func mergeInfo(addrs []string, infos [][]byte) []byte {
+	sections := make([]*infoSection, 0)
+	index := make(map[string]*infoSection)
+	for i, info := range infos {
+		var section *infoSection
+		for _, line := range strings.Split(string(info), "\r\n") {
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+				continue
+			case line[0] == '#':
+				name := strings.TrimSpace(line[1:])
+				if section = index[name]; section == nil {
+					section = &infoSection{name: name, values: make(map[string][]string)}
+					index[name] = section
+					sections = append(sections, section)
+				}
+				continue
+			case section == nil:
+				continue
+			}
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			values, ok := section.values[kv[0]]
+			if !ok {
+				values = make([]string, len(infos))
+				section.keys = append(section.keys, kv[0])
+			}
+			values[i] = kv[1]
+			section.values[kv[0]] = values
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, section := range sections {
+		buf.WriteString("# " + section.name + "\r\n")
+		for _, key := range section.keys {
+			buf.WriteString(key + ":" + mergeInfoValue(section.values[key], summableSections[section.name]) + "\r\n")
+		}
+		buf.WriteString("\r\n")
+	}
+
+	buf.WriteString("# Nodes\r\n")
+	buf.WriteString("nodes:" + strconv.Itoa(len(infos)) + "\r\n")
+	for i := range infos {
+		fields := []string{"addr=" + addrs[i]}
+		for _, key := range []string{"role", "connected_clients", "used_memory", "total_commands_processed"} {
+			for _, section := range sections {
+				if values, ok := section.values[key]; ok && values[i] != "" {
+					fields = append(fields, key+"="+values[i])
+				}
+			}
+		}
+		if keyspace, ok := index["Keyspace"]; ok {
+			var keys int64
+			for _, key := range keyspace.keys {
+				keys += infoSubField(keyspace.values[key][i], "keys")
+			}
+			fields = append(fields, "keys="+strconv.FormatInt(keys, 10))
+		}
+		buf.WriteString("node" + strconv.Itoa(i) + ":" + strings.Join(fields, ",") + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// mergeInfoValue merge values of a field on all nodes, missing ones are empty.
+// Integers of summable sections are summed even if they're the same on all nodes
+func mergeInfoValue(values []string, summable bool) string {
+	first := ""
+	for _, v := range values {
+		if v != "" {
+			first = v
+			break
+		}
+	}
+	if !summable || first == "" {
+		return first
+	}
+
+	// integer
+	var sum int64
+	isInt := true
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			isInt = false
+			break
+		}
+		sum += n
+	}
+	if isInt {
+		return strconv.FormatInt(sum, 10)
+	}
+
+	// k=v,k=v with integer values summed, e.g. keyspace and commandstats
+	parts := strings.Split(first, ",")
+	sums := make(map[string]int64)
+	for _, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return first
+		}
+		if _, err := strconv.ParseInt(kv[1], 10, 64); err != nil || strings.HasPrefix(kv[0], "avg_") {
+			// averages can't be summed
+			continue
+		}
+		for _, v := range values {
+			sums[kv[0]] += infoSubField(v, kv[0])
+		}
+	}
+	merged := make([]string, 0, len(parts))
+	for _, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if sum, ok := sums[kv[0]]; ok {
+			merged = append(merged, kv[0]+"="+strconv.FormatInt(sum, 10))
+		} else if kv[0] == "usec_per_call" && sums["calls"] > 0 {
+			perCall := float64(sums["usec"]) / float64(sums["calls"])
+			merged = append(merged, kv[0]+"="+strconv.FormatFloat(perCall, 'f', 2, 64))
+		} else {
+			merged = append(merged, part)
+		}
+	}
+	return strings.Join(merged, ",")
+}
+
+// infoSubField return integer field of value like keys=1,expires=0, 0 if not found
+func infoSubField(value string, field string) int64 {
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && kv[0] == field {
+			n, _ := strconv.ParseInt(kv[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
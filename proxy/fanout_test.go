@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeInfo(t *testing.T) {
+	infos := [][]byte{
+		[]byte("# Server\r\nredis_version:7.0.0\r\ntcp_port:7101\r\n\r\n" +
+			"# Clients\r\nconnected_clients:2\r\n\r\n" +
+			"# Memory\r\nused_memory:100\r\nused_memory_human:100B\r\n\r\n" +
+			"# Replication\r\nrole:master\r\n\r\n" +
+			"# Commandstats\r\ncmdstat_get:calls=3,usec=30,usec_per_call=10.00\r\n\r\n" +
+			"# Keyspace\r\ndb0:keys=5,expires=1,avg_ttl=100\r\n"),
+		[]byte("# Server\r\nredis_version:7.0.0\r\ntcp_port:7102\r\n\r\n" +
+			"# Clients\r\nconnected_clients:3\r\n\r\n" +
+			"# Memory\r\nused_memory:50\r\nused_memory_human:50B\r\n\r\n" +
+			"# Replication\r\nrole:master\r\n\r\n" +
+			"# Commandstats\r\ncmdstat_get:calls=1,usec=20,usec_per_call=20.00\r\ncmdstat_set:calls=2,usec=4,usec_per_call=2.00\r\n\r\n" +
+			"# Keyspace\r\ndb0:keys=7,expires=0,avg_ttl=300\r\n"),
+	}
+	got := string(mergeInfo([]string{"127.0.0.1:7101", "127.0.0.1:7102"}, infos))
+	want := "# Server\r\nredis_version:7.0.0\r\ntcp_port:7101\r\n\r\n" +
+		"# Clients\r\nconnected_clients:5\r\n\r\n" +
+		"# Memory\r\nused_memory:150\r\nused_memory_human:100B\r\n\r\n" +
+		"# Replication\r\nrole:master\r\n\r\n" +
+		"# Commandstats\r\ncmdstat_get:calls=4,usec=50,usec_per_call=12.50\r\ncmdstat_set:calls=2,usec=4,usec_per_call=2.00\r\n\r\n" +
+		"# Keyspace\r\ndb0:keys=12,expires=1,avg_ttl=100\r\n\r\n" +
+		"# Nodes\r\nnodes:2\r\n" +
+		"node0:addr=127.0.0.1:7101,role=master,connected_clients=2,used_memory=100,keys=5\r\n" +
+		"node1:addr=127.0.0.1:7102,role=master,connected_clients=3,used_memory=50,keys=7\r\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", strings.Replace(got, "\r\n", "\n", -1), strings.Replace(want, "\r\n", "\n", -1))
+	}
+}
+
+func TestMergeInfoValue(t *testing.T) {
+	tests := []struct {
+		values   []string
+		summable bool
+		want     string
+	}{
+		{[]string{"1", "1"}, true, "2"},
+		{[]string{"1", "1"}, false, "1"},
+		{[]string{"1", "2"}, true, "3"},
+		{[]string{"1", "2"}, false, "1"},
+		{[]string{"", "2"}, true, "2"},
+		{[]string{"1.5", "2.5"}, true, "1.5"},
+		{[]string{"keys=1,expires=0", "keys=2,expires=1"}, true, "keys=3,expires=1"},
+		{[]string{"keys=5,expires=0", "keys=5,expires=0"}, true, "keys=10,expires=0"},
+		{[]string{"keys=1,avg_ttl=5", "keys=2,avg_ttl=9"}, true, "keys=3,avg_ttl=5"},
+		{[]string{"calls=3,usec=30,usec_per_call=10.00", "calls=1,usec=20,usec_per_call=20.00"}, true, "calls=4,usec=50,usec_per_call=12.50"},
+		{[]string{"calls=0,usec=0,usec_per_call=0.00", ""}, true, "calls=0,usec=0,usec_per_call=0.00"},
+		{[]string{"1.00M", "2.00M"}, true, "1.00M"},
+		{[]string{"", ""}, true, ""},
+	}
+	for _, test := range tests {
+		if got := mergeInfoValue(test.values, test.summable); got != test.want {
+			t.Errorf("%q summable %v: got %q, want %q", test.values, test.summable, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// helloDo handle HELLO [protover [AUTH username password] [SETNAME clientname]].
+// Replies to a RESP3 session come from connections to nodes speaking RESP3 too,
+// so they are forwarded as they are
+func (sess *session) helloDo(proxy Proxy, args [][]byte) ([]byte, error) {
+	proto := sess.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return nil, redisError("ERR Protocol version is not an integer or out of range")
+		}
+		// nodes before redis 6 don't speak RESP3
+		if (v != RESP2 && v != RESP3) || (v == RESP3 && !supportsRESP3(proxy.serverVersion())) {
+			return nil, redisError("NOPROTO unsupported protocol version")
+		}
+		proto = v
+		args = args[1:]
+	}
+
+	a := proxy.getACL()
+	var user *aclUser
+	var name string
+	setName := false
+	for len(args) > 0 {
+		opt := strings.ToUpper(string(args[0]))
+		switch {
+		case opt == "AUTH" && len(args) >= 3:
+			username, password := string(args[1]), string(args[2])
+			// the default user has no password if clients needn't authenticate
+			if a.required() || username != DEFAULTUSER {
+				if user = a.authenticate(username, password); user == nil {
+					return nil, redisError("WRONGPASS invalid username-password pair or user is disabled.")
+				}
+			}
+			args = args[3:]
+		case opt == "SETNAME" && len(args) >= 2:
+			name, setName = string(args[1]), true
+			if strings.ContainsAny(name, " \n") {
+				return nil, redisError("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			args = args[2:]
+		default:
+			return nil, redisError("ERR Syntax error in HELLO option '" + string(args[0]) + "'")
+		}
+	}
+
+	if current, _ := sess.user.Load().(*aclUser); user == nil && current == nil && a.required() {
+		return nil, redisError("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate " +
+			"the client and select the RESP protocol version at the same time")
+	}
+	// dedicated connections of subscriptions and transactions keep their protocol
+	if proto != sess.proto && (sess.sub.active() || sess.sub.tracking() || sess.tx.watching) {
+		return nil, protocolError("HELLO can't switch protocol in subscriber mode, tracking or WATCH")
+	}
+
+	if user != nil {
+		sess.user.Store(user)
+	}
+	if setName {
+		sess.setName(name)
+	}
+	sess.proto = proto
+	return helloReply(proxy, sess.id, proto), nil
+}
+
+// supportsRESP3 tell if redis of version speaks RESP3, unknown version is assumed to
+func supportsRESP3(version string) bool {
+	if version == "" {
+		return true
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return err != nil || major >= 6
+}
+
+// helloReply describe the proxy like a redis server, it's a map in RESP3
+func helloReply(proxy Proxy, id uint64, proto int) []byte {
+	version := proxy.serverVersion()
+	if version == "" {
+		version = "unknown"
+	}
+	fields := []interface{}{
+		[]byte("server"), []byte("redis"),
+		[]byte("version"), []byte(version),
+		[]byte("proto"), int64(proto),
+		[]byte("id"), int64(id),
+		[]byte("mode"), []byte("cluster"),
+		[]byte("role"), []byte("master"),
+		[]byte("modules"), []interface{}{},
+	}
+	if proto == RESP3 {
+		return encodeReply(respMap(fields))
+	}
+	return encodeReply(fields)
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latency buckets of histograms in second
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// histogram counts observations into cumulative buckets like prometheus histograms,
+// it's lock free
+type histogram struct {
+	counts []uint64
+	count  uint64
+	// sum in microsecond
+	sum uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d/time.Microsecond))
+}
+
+// commandDuration is latency of all client requests
+var commandDuration = newHistogram()
+
+// metricsWriter write metrics in prometheus text format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) head(name, typ, help string) {
+	mw.w.WriteString("# HELP " + name + " " + help + "\n")
+	mw.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func (mw *metricsWriter) sample(name, labels string, value string) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	mw.w.WriteString(name + " " + value + "\n")
+}
+
+func (mw *metricsWriter) uint(name, labels string, value uint64) {
+	mw.sample(name, labels, strconv.FormatUint(value, 10))
+}
+
+func (mw *metricsWriter) float(name, labels string, value float64) {
+	mw.sample(name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (mw *metricsWriter) histogram(name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		mw.uint(name+"_bucket", labels+sep+`le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`, cumulative)
+	}
+	count := atomic.LoadUint64(&h.count)
+	mw.uint(name+"_bucket", labels+sep+`le="+Inf"`, count)
+	mw.float(name+"_sum", labels, float64(atomic.LoadUint64(&h.sum))/1e6)
+	mw.uint(name+"_count", labels, count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// WriteMetrics write metrics of proxy in prometheus text format
+func (p *proxy) WriteMetrics(w io.Writer) error {
+	mw := &metricsWriter{bufio.NewWriter(w)}
+
+	sessionLock.Lock()
+	clients, received := len(sessions), totalSessions
+	sessionLock.Unlock()
+
+	mw.head("redis_proxy_uptime_seconds", "gauge", "Seconds since the proxy started.")
+	mw.float("redis_proxy_uptime_seconds", "", time.Since(startTime).Seconds())
+	mw.head("redis_proxy_connected_clients", "gauge", "Number of client connections.")
+	mw.uint("redis_proxy_connected_clients", "", uint64(clients))
+	mw.head("redis_proxy_connections_received_total", "counter", "Client connections accepted.")
+	mw.uint("redis_proxy_connections_received_total", "", received)
+
+	names := make([]string, 0)
+	commandStats.Range(func(k, v interface{}) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	mw.head("redis_proxy_requests_total", "counter", "Requests executed, including unknown commands.")
+	mw.uint("redis_proxy_requests_total", "", atomic.LoadUint64(&totalOps))
+	mw.head("redis_proxy_commands_total", "counter", "Requests executed by command.")
+	for _, name := range names {
+		v, _ := commandStats.Load(name)
+		mw.uint("redis_proxy_commands_total", label("command", name), atomic.LoadUint64(&v.(*commandStat).calls))
+	}
+	mw.head("redis_proxy_command_errors_total", "counter", "Requests replied with an error by command.")
+	for _, name := range names {
+		v, _ := commandStats.Load(name)
+		mw.uint("redis_proxy_command_errors_total", label("command", name), atomic.LoadUint64(&v.(*commandStat).failed))
+	}
+	mw.head("redis_proxy_command_duration_seconds_total", "counter", "Time spent executing requests by command.")
+	for _, name := range names {
+		v, _ := commandStats.Load(name)
+		mw.float("redis_proxy_command_duration_seconds_total", label("command", name), float64(atomic.LoadUint64(&v.(*commandStat).usec))/1e6)
+	}
+	mw.head("redis_proxy_command_duration_seconds", "histogram", "Latency of requests.")
+	mw.histogram("redis_proxy_command_duration_seconds", "", commandDuration)
+	mw.head("redis_proxy_rate_limited_total", "counter", "Requests rejected by rate limits.")
+	for _, name := range limitNames {
+		mw.uint("redis_proxy_rate_limited_total", label("limit", name), atomic.LoadUint64(rateLimited[name]))
+	}
+
+	mw.head("redis_proxy_redirections_total", "counter", "MOVED and ASK redirections followed.")
+	mw.uint("redis_proxy_redirections_total", label("type", "moved"), atomic.LoadUint64(&p.movedCount))
+	mw.uint("redis_proxy_redirections_total", label("type", "ask"), atomic.LoadUint64(&p.askCount))
+	mw.head("redis_proxy_slot_map_refreshes_total", "counter", "Slot map refreshes from the cluster.")
+	mw.uint("redis_proxy_slot_map_refreshes_total", "", atomic.LoadUint64(&p.slotRefreshes))
+	mw.head("redis_proxy_slot_map_version", "gauge", "Number of slot map changes.")
+	mw.uint("redis_proxy_slot_map_version", "", atomic.LoadUint64(&p.slotVersion))
+
+	p.backendLock.Lock()
+	addrs := make([]string, 0, len(p.backend))
+	backends := make(map[string]*backend)
+	for addr, b := range p.backend {
+		addrs = append(addrs, addr)
+		backends[addr] = b
+	}
+	p.backendLock.Unlock()
+	sort.Strings(addrs)
+
+	mw.head("redis_proxy_backend_requests_total", "counter", "Requests sent to node.")
+	for _, addr := range addrs {
+		mw.uint("redis_proxy_backend_requests_total", label("addr", addr), atomic.LoadUint64(&backends[addr].requests))
+	}
+	mw.head("redis_proxy_backend_errors_total", "counter", "Requests to node failed without reply.")
+	for _, addr := range addrs {
+		mw.uint("redis_proxy_backend_errors_total", label("addr", addr), atomic.LoadUint64(&backends[addr].errors))
+	}
+	mw.head("redis_proxy_backend_reconnects_total", "counter", "Broken connections to node established again.")
+	for _, addr := range addrs {
+		mw.uint("redis_proxy_backend_reconnects_total", label("addr", addr), atomic.LoadUint64(&backends[addr].reconnects))
+	}
+	mw.head("redis_proxy_backend_connections", "gauge", "Established connections to node.")
+	for _, addr := range addrs {
+		_, established, _ := backends[addr].usage()
+		mw.uint("redis_proxy_backend_connections", label("addr", addr), uint64(established))
+	}
+	mw.head("redis_proxy_backend_pending_requests", "gauge", "Requests queued or waiting for reply of node.")
+	for _, addr := range addrs {
+		_, _, pending := backends[addr].usage()
+		mw.uint("redis_proxy_backend_pending_requests", label("addr", addr), uint64(pending))
+	}
+	mw.head("redis_proxy_backend_pool_wait_seconds", "histogram", "Time requests wait for a pooled connection to node.")
+	for _, addr := range addrs {
+		mw.histogram("redis_proxy_backend_pool_wait_seconds", label("addr", addr), backends[addr].poolWait)
+	}
+	return mw.w.Flush()
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// multiKeyCmds are commands whose keys may live in different slots,
+// key positions are taken from the command table
+var multiKeyCmds = map[string]bool{
+	"MGET":   true,
+	"MSET":   true,
+	"DEL":    true,
+	"EXISTS": true,
+	"UNLINK": true,
+	"TOUCH":  true,
+}
+
+type subResult struct {
+	reply interface{}
+	err   error
+}
+
+// multiKeyDo split a multi-key command by slot, send each sub-command to the node
+// owns the slot, and merge the replies back in the original key order.
+// args doesn't contain the command name itself, read-only sub-commands go to
+// the node picked by read policy if readReplica is true. queued is called once
+// all sub-commands are queued on connections of their slots, it may be nil
+func (p *proxy) multiKeyDo(cmd string, args [][]byte, readReplica bool, queued func()) ([]byte, error) {
+	step := 1
+	if c := lookupCommand(cmd); c != nil && c.step > 0 {
+		step = c.step
+	}
+	if len(args) == 0 || len(args)%step != 0 {
+		return nil, protocolError("wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+	}
+
+	// key indexes grouped by slot, in the order of slot first seen
+	groups := make(map[uint16][]int)
+	order := make([]uint16, 0)
+	for i := 0; i < len(args); i += step {
+		slot := KeySlot(args[i])
+		if _, ok := groups[slot]; !ok {
+			order = append(order, slot)
+		}
+		groups[slot] = append(groups[slot], i)
+	}
+
+	subCmd := func(slot uint16) []byte {
+		sub := [][]byte{[]byte(cmd)}
+		for _, i := range groups[slot] {
+			sub = append(sub, args[i:i+step]...)
+		}
+		return encodeCmd(sub)
+	}
+
+	// a sub-command may be queued again after MOVED or ASK, it's counted once
+	left := int32(len(order))
+	slotDo := func(cmd []byte, slot uint16) ([]byte, error) {
+		fw := &forwarding{}
+		if queued != nil {
+			var once sync.Once
+			fw.queued = func() {
+				once.Do(func() {
+					if atomic.AddInt32(&left, -1) == 0 {
+						queued()
+					}
+				})
+			}
+		}
+		return p.streamDo(cmd, slot, readReplica, RESP2, fw)
+	}
+
+	// all keys in the same slot, nothing to merge
+	if len(order) == 1 {
+		return slotDo(subCmd(order[0]), order[0])
+	}
+
+	results := make([]subResult, len(order))
+	var wg sync.WaitGroup
+	for n, slot := range order {
+		wg.Add(1)
+		go func(n int, slot uint16) {
+			defer wg.Done()
+			resp, err := slotDo(subCmd(slot), slot)
+			if err != nil {
+				results[n] = subResult{nil, err}
+				return
+			}
+			reply, err := parseReply(resp)
+			results[n] = subResult{reply, err}
+		}(n, slot)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	switch cmd {
+	case "MGET":
+		merged := make([]interface{}, len(args))
+		for n, slot := range order {
+			values, ok := results[n].reply.([]interface{})
+			if !ok || len(values) != len(groups[slot]) {
+				return nil, protocolError("bad MGET reply from backend")
+			}
+			for j, i := range groups[slot] {
+				merged[i] = values[j]
+			}
+		}
+		return encodeReply(merged), nil
+	case "MSET":
+		return encodeReply(okReply), nil
+	default:
+		// DEL, EXISTS, UNLINK, TOUCH reply the number of keys
+		var sum int64
+		for _, r := range results {
+			n, ok := r.reply.(int64)
+			if !ok {
+				return nil, protocolError("bad " + cmd + " reply from backend")
+			}
+			sum += n
+		}
+		return encodeReply(sum), nil
+	}
+}
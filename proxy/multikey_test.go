@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testNode is a node serving the slots below testSplit if low is set, or the
+// others. Commands of keys in different slots or not served are refused, commands
+// it receives are recorded
+type testNode struct {
+	low   bool
+	store map[string]string
+	lock  sync.Mutex
+	cmds  []string
+}
+
+const testSplit = SLOTSIZE / 2
+
+func (n *testNode) owns(key []byte) bool {
+	return (KeySlot(key) < testSplit) == n.low
+}
+
+func (n *testNode) serve(conn net.Conn) {
+	c := NewConn(conn, 0, 0)
+	for {
+		_, args, err := c.readRequest(false)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(string(args[0]))
+		keys := lookupCommand(name).keys(args[1:])
+		n.lock.Lock()
+		fields := make([]string, 0, len(args))
+		for _, arg := range args {
+			fields = append(fields, string(arg))
+		}
+		n.cmds = append(n.cmds, strings.Join(fields, " "))
+		var reply interface{}
+		for _, key := range keys {
+			if !n.owns(key) || KeySlot(key) != KeySlot(keys[0]) {
+				reply = redisError("CROSSSLOT Keys in request don't hash to the same slot")
+			}
+		}
+		if reply == nil {
+			switch name {
+			case "MGET":
+				values := make([]interface{}, 0)
+				for _, key := range keys {
+					if v, ok := n.store[string(key)]; ok {
+						values = append(values, []byte(v))
+					} else {
+						values = append(values, nil)
+					}
+				}
+				reply = values
+			case "MSET":
+				for i := 1; i+1 < len(args); i += 2 {
+					n.store[string(args[i])] = string(args[i+1])
+				}
+				reply = okReply
+			case "DEL", "EXISTS":
+				var count int64
+				for _, key := range keys {
+					if _, ok := n.store[string(key)]; ok {
+						count++
+						if name == "DEL" {
+							delete(n.store, string(key))
+						}
+					}
+				}
+				reply = count
+			}
+		}
+		n.lock.Unlock()
+		if err, ok := reply.(error); ok {
+			c.writeBytes([]byte("-" + err.Error() + "\r\n"))
+		} else {
+			c.writeBytes(encodeReply(reply))
+		}
+	}
+}
+
+// testCluster return a proxy of two nodes splitting the slots, and the nodes
+func testCluster(t *testing.T) (*proxy, []*testNode) {
+	nodes := []*testNode{
+		{low: true, store: make(map[string]string)},
+		{low: false, store: make(map[string]string)},
+	}
+	addrs := []string{"127.0.0.1:7101", "127.0.0.1:7102"}
+	p := &proxy{
+		totalSlots: SLOTSIZE,
+		slotMap:    make([]string, SLOTSIZE),
+		backend:    make(map[string]*backend),
+	}
+	p.conf.Store(DefaultConfig())
+	for i := range p.slotMap {
+		if i < testSplit {
+			p.slotMap[i] = addrs[0]
+		} else {
+			p.slotMap[i] = addrs[1]
+		}
+	}
+	for i, node := range nodes {
+		node := node
+		p.backend[addrs[i]] = newBackend(addrs[i], 1, RESP2, func(addr string, proto int) (RedisConn, error) {
+			client, server := net.Pipe()
+			go node.serve(server)
+			return NewConn(client, 0, 0), nil
+		})
+	}
+	t.Cleanup(func() {
+		for _, b := range p.backend {
+			b.close()
+		}
+	})
+	return p, nodes
+}
+
+func TestMultiKeyDo(t *testing.T) {
+	// b, c and f are in the lower half of slots, d, e and y in the upper half
+	for _, key := range []string{"b", "c", "f"} {
+		if KeySlot([]byte(key)) >= testSplit {
+			t.Fatalf("slot of %s is %d", key, KeySlot([]byte(key)))
+		}
+	}
+	for _, key := range []string{"d", "e", "y", "{t}"} {
+		if KeySlot([]byte(key)) < testSplit {
+			t.Fatalf("slot of %s is %d", key, KeySlot([]byte(key)))
+		}
+	}
+
+	tests := []struct {
+		cmd  string
+		want interface{}
+		// sub-commands received by each node, sorted
+		sub [][]string
+	}{
+		{"MSET f 1 d 4 b 2", okReply, [][]string{{"MSET b 2", "MSET f 1"}, {"MSET d 4"}}},
+		{"MGET d f y e b", []interface{}{[]byte("4"), []byte("1"), nil, nil, []byte("2")},
+			[][]string{{"MGET b", "MGET f"}, {"MGET d", "MGET e", "MGET y"}}},
+		{"MGET {t}1 {t}2", []interface{}{nil, nil}, [][]string{{}, {"MGET {t}1 {t}2"}}},
+		{"EXISTS f d e f", int64(3), [][]string{{"EXISTS f f"}, {"EXISTS d", "EXISTS e"}}},
+		{"DEL f c d e", int64(2), [][]string{{"DEL c", "DEL f"}, {"DEL d", "DEL e"}}},
+		{"MGET f b d", []interface{}{nil, []byte("2"), nil}, [][]string{{"MGET b", "MGET f"}, {"MGET d"}}},
+	}
+	p, nodes := testCluster(t)
+	for _, test := range tests {
+		for _, node := range nodes {
+			node.cmds = nil
+		}
+		args := make([][]byte, 0)
+		for _, f := range strings.Fields(test.cmd)[1:] {
+			args = append(args, []byte(f))
+		}
+		queued := 0
+		resp, err := p.multiKeyDo(strings.Fields(test.cmd)[0], args, false, func() { queued++ })
+		if err != nil {
+			t.Errorf("%s: %v", test.cmd, err)
+			continue
+		}
+		if queued != 1 {
+			t.Errorf("%s: queued %d times", test.cmd, queued)
+		}
+		if got := string(resp); got != string(encodeReply(test.want)) {
+			t.Errorf("%s: got %q, want %q", test.cmd, got, encodeReply(test.want))
+		}
+		for i, node := range nodes {
+			got := append([]string{}, node.cmds...)
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(test.sub[i], ",") {
+				t.Errorf("%s: node %d got %q, want %q", test.cmd, i, got, test.sub[i])
+			}
+		}
+	}
+}
@@ -1,63 +1,273 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Proxy interface {
 	Close() error
 	do([]byte) ([]byte, error)
-	slotDo([]byte, uint16) ([]byte, error)
+	slotDo([]byte, uint16, int) ([]byte, error)
+	readSlotDo([]byte, uint16, int) ([]byte, error)
+	streamDo([]byte, uint16, bool, int, *forwarding) ([]byte, error)
+	multiKeyDo(string, [][]byte, bool, func()) ([]byte, error)
+	broadcastDo([]byte) ([]interface{}, error)
+	evalDo(string, [][]byte, [][]byte, bool, int) ([]byte, error)
+	scriptDo([][]byte) ([]byte, error)
+	scanDo([][]byte) ([]byte, error)
+	fanoutDo(string, [][]byte) ([]byte, error)
+	blockingDo([]byte, uint16, time.Duration, <-chan struct{}, int) ([]byte, error)
+	nodeAddr(uint16) string
+	masters() []string
+	serverVersion() string
+	dedicatedConn(string, int64, int) (RedisConn, error)
+	RefreshCommands() error
+	Reload(*Config) error
+	WriteMetrics(io.Writer) error
+	getACL() *acl
+	getRateLimiter() *rateLimiter
 	GetAddr()
 }
 
 type proxy struct {
-	totalSlots   int
-	slotMap      []string
-	addrList     []string
-	chanSize     int
-	backend      map[string](chan RedisConn)
+	// *Config replaced by Reload
+	conf       atomic.Value
+	totalSlots int
+	slotMap    []string
+	// masters of cluster, guarded by slotMapMutex
+	addrList []string
+	// replicas of each master, guarded by slotMapMutex
+	replicas map[string][]string
+	// times each node lost slots, guarded by slotMapMutex, see scanDo
+	slotLosses map[string]uint64
+	// counter for round-robin read policy
+	readCounter  uint64
+	backend      map[string]*backend
 	adminConn    RedisConn
 	slotMapMutex sync.RWMutex
 	backendLock  sync.Mutex
+	// notify keepalive() to refresh slot map
+	refreshCh chan struct{}
+	scripts   *scriptCache
+	// *acl of clients, replaced by Reload
+	acl atomic.Value
+	// *rateLimiter, nil if nothing is limited, replaced by Reload
+	limiter atomic.Value
+	// nil if connections to nodes are not encrypted
+	tlsConf *tls.Config
+	// redis_version of the cluster, reported by HELLO
+	version string
+	// counters of redirections and slot map changes, slotVersion changes under
+	// slotMapMutex along with the slot map
+	movedCount    uint64
+	askCount      uint64
+	slotVersion   uint64
+	slotRefreshes uint64
+	// idle connections for blocking commands by node address and protocol
+	blockingIdle map[blockingKey][]RedisConn
+	blockingLock sync.Mutex
+	// closed by Close to stop keepalive(), which closes keepaliveDone once it returns
+	quit          chan struct{}
+	keepaliveDone chan struct{}
 }
 
-func NewProxy(address string) Proxy {
-	net, err := net.Dial("tcp", address)
+// NewProxy connect to the cluster through the first available node of conf.Seeds
+func NewProxy(conf *Config) (Proxy, error) {
+	if err := conf.Check(); err != nil {
+		return nil, err
+	}
+	users, err := newACL(conf)
 	if err != nil {
-		log.Fatal("failed to dail cluster " + address + " " + err.Error())
+		return nil, err
+	}
+	var tlsConf *tls.Config
+	if conf.BackendTLS.Enabled {
+		if tlsConf, err = conf.BackendTLS.clientConfig(); err != nil {
+			return nil, err
+		}
 	}
 	p := &proxy{
 		totalSlots:   SLOTSIZE,
 		slotMap:      nil,
 		addrList:     nil,
-		chanSize:     BACKENSIZE,
+		replicas:     nil,
 		backend:      nil,
-		adminConn:    NewConn(net, 10, 10),
+		adminConn:    nil,
 		slotMapMutex: sync.RWMutex{},
 		backendLock:  sync.Mutex{},
+		refreshCh:    make(chan struct{}, 1),
+		quit:         make(chan struct{}),
+		scripts:      newScriptCache(),
+		tlsConf:      tlsConf,
+		blockingIdle: make(map[blockingKey][]RedisConn),
+	}
+	p.conf.Store(conf)
+	p.acl.Store(users)
+	p.limiter.Store(newRateLimiter(&conf.RateLimit))
+	setCommandRules(conf.AllowCommands, conf.DenyCommands)
+	for _, seed := range conf.Seeds {
+		err := p.connectSeed(seed)
+		if err == nil {
+			break
+		}
+		log.Println("seed node", seed, "unavailable.", err)
+	}
+	if p.adminConn == nil {
+		return nil, protocolError("no seed node available")
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// connectSeed use addr as admin connection if the cluster state is ok
+func (p *proxy) connectSeed(addr string) error {
+	conn, err := p.dial(addr)
+	if err != nil {
+		return err
+	}
+	p.adminConn = conn
+	if err := p.checkState(); err != nil {
+		p.adminConn = nil
+		conn.close()
+		if strings.HasPrefix(err.Error(), "NOAUTH") {
+			return &authError{Address: addr, Reason: "node requires password, set backend_password"}
+		}
+		return err
+	}
+	log.Println("connected to cluster through seed node", addr)
+	return nil
+}
+
+// dial connect to a node with timeouts in config
+func (p *proxy) dial(addr string) (RedisConn, error) {
+	return p.dialConn(addr, int64(p.config().ReadTimeout))
+}
+
+// poolConn dial a connection of backend pools speaking proto
+func (p *proxy) poolConn(addr string, proto int) (RedisConn, error) {
+	return p.dedicatedConn(addr, -1, proto)
+}
+
+// dedicatedConn dial a connection for subscriptions, transactions, blocking commands
+// and backend pools. readTimeout is in millisecond, 0 means no timeout,
+// negative means the configured read timeout. HELLO is sent if proto is not RESP2
+func (p *proxy) dedicatedConn(addr string, readTimeout int64, proto int) (RedisConn, error) {
+	if readTimeout < 0 {
+		readTimeout = int64(p.config().ReadTimeout)
+	}
+	conn, err := p.dialConn(addr, readTimeout)
+	if err != nil || proto == RESP2 {
+		return conn, err
+	}
+	conn.writeBytes(helloCmds[proto])
+	_, err = conn.readReply()
+	conn.clear()
+	if err != nil {
+		conn.close()
+		return nil, protocolError("HELLO failed " + err.Error())
+	}
+	return conn, nil
+}
+
+// dialConn connect to a node over TLS if it's enabled and authenticate if credentials
+// are configured, READONLY is sent when reading from replicas is enabled, it's harmless
+// on masters
+func (p *proxy) dialConn(addr string, readTimeout int64) (RedisConn, error) {
+	conf := p.config()
+	var netConn net.Conn
+	var err error
+	if p.tlsConf != nil {
+		dialer := &net.Dialer{Timeout: conf.dialTimeout()}
+		netConn, err = tls.DialWithDialer(dialer, "tcp", addr, p.tlsConf)
+	} else {
+		netConn, err = net.DialTimeout("tcp", addr, conf.dialTimeout())
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := NewConn(netConn, readTimeout, int64(conf.WriteTimeout))
+	if err := p.auth(conn, addr, conf); err != nil {
+		conn.close()
+		return nil, err
+	}
+	if conf.ReadPolicy != ReadMaster {
+		conn.writeCmd("READONLY")
+		_, err := conn.readReply()
+		conn.clear()
+		if err != nil {
+			conn.close()
+			return nil, protocolError("READONLY failed " + err.Error())
+		}
+	}
+	return conn, nil
+}
+
+// auth send AUTH with backend credentials, error replies are returned as authError
+func (p *proxy) auth(conn RedisConn, addr string, conf *Config) error {
+	if conf.BackendPassword == "" {
+		return nil
+	}
+	args := [][]byte{[]byte("AUTH"), []byte(conf.BackendPassword)}
+	if conf.BackendUser != "" {
+		args = [][]byte{[]byte("AUTH"), []byte(conf.BackendUser), []byte(conf.BackendPassword)}
+	}
+	if err := conn.writeBytes(encodeCmd(args)); err != nil {
+		return err
+	}
+	_, err := conn.readReply()
+	conn.clear()
+	if err != nil && isReplyError(err) {
+		return &authError{Address: addr, Reason: err.Error()}
 	}
-	p.init()
-	return p
+	return err
+}
+
+func (p *proxy) getACL() *acl {
+	return p.acl.Load().(*acl)
+}
+
+func (p *proxy) getRateLimiter() *rateLimiter {
+	return p.limiter.Load().(*rateLimiter)
+}
+
+func (p *proxy) config() *Config {
+	return p.conf.Load().(*Config)
 }
 
 func (p *proxy) GetAddr() {
 	log.Println(p.adminConn)
 }
 
-// close connection
+// close connection, keepalive() is stopped first so no backend is checked while closed
 func (p *proxy) Close() error {
+	close(p.quit)
+	if p.keepaliveDone != nil {
+		<-p.keepaliveDone
+	}
 	log.Println("closing backend connection")
-	for _, addr := range p.addrList {
-		for conn := range p.backend[addr] {
+	p.backendLock.Lock()
+	for _, b := range p.backend {
+		b.close()
+	}
+	p.backendLock.Unlock()
+	p.blockingLock.Lock()
+	for _, idle := range p.blockingIdle {
+		for _, conn := range idle {
 			conn.close()
 		}
 	}
+	p.blockingIdle = make(map[blockingKey][]RedisConn)
+	p.blockingLock.Unlock()
 	return nil
 }
 
@@ -65,6 +275,7 @@ func (p *proxy) Close() error {
 func (p *proxy) checkState() error {
 	p.adminConn.writeCmd("CLUSTER INFO")
 	reply, err := p.adminConn.readReply()
+	p.adminConn.clear()
 	if err != nil {
 		return err
 	}
@@ -82,31 +293,92 @@ func (p *proxy) checkState() error {
 	return protocolError("checkState should never run up to here")
 }
 
-func (p *proxy) init() {
+func (p *proxy) init() error {
 	p.slotMap = make([]string, p.totalSlots)
 	p.addrList = make([]string, 0)
-	p.backend = make(map[string](chan RedisConn))
-	// TODO: check redis cluster is READY!
-	err := p.checkState()
-	if err != nil {
-		log.Fatal(err)
+	p.replicas = make(map[string][]string)
+	p.slotLosses = make(map[string]uint64)
+	p.backend = make(map[string]*backend)
+	if err := p.initSlotMap(); err != nil {
+		return err
 	}
-	p.initSlotMap()
+	if err := p.RefreshCommands(); err != nil {
+		log.Println("refresh command table failed, use the builtin one.", err)
+	}
+	p.refreshVersion()
+	p.keepaliveDone = make(chan struct{})
 	go p.keepalive()
+	return nil
+}
+
+// reconnectAdmin replace the admin connection with one to any available node
+func (p *proxy) reconnectAdmin() error {
+	if p.adminConn != nil {
+		p.adminConn.close()
+		p.adminConn = nil
+	}
+	candidates := append(append([]string{}, p.addrList...), p.config().Seeds...)
+	for _, addr := range candidates {
+		if err := p.connectSeed(addr); err == nil {
+			return nil
+		}
+	}
+	return protocolError("no node available for admin connection")
+}
+
+// RefreshCommands update the command table with COMMAND reply of the cluster
+func (p *proxy) RefreshCommands() error {
+	p.adminConn.writeCmd("COMMAND")
+	reply, err := p.adminConn.readReply()
+	p.adminConn.clear()
+	if err != nil {
+		return err
+	}
+	n, err := refreshCommandTable(reply)
+	if err != nil {
+		return err
+	}
+	log.Println("command table refreshed,", n, "commands from cluster")
+	return nil
+}
+
+// refreshVersion get redis_version from INFO of the admin node
+func (p *proxy) refreshVersion() {
+	p.adminConn.writeCmd("INFO server")
+	reply, err := p.adminConn.readReply()
+	p.adminConn.clear()
+	if err != nil {
+		log.Println("get redis version failed.", err)
+		return
+	}
+	info, _ := reply.([]byte)
+	for _, line := range strings.Split(string(info), "\r\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			p.version = strings.TrimPrefix(line, "redis_version:")
+		}
+	}
+}
+
+func (p *proxy) serverVersion() string {
+	return p.version
 }
 
 // initSlotMap get nodes list and slot distribution
-func (p *proxy) initSlotMap() {
+func (p *proxy) initSlotMap() error {
 	p.adminConn.writeCmd("CLUSTER SLOTS")
 	reply, err := p.adminConn.readReply()
+	p.adminConn.clear()
 	if err != nil {
-		log.Fatal("cluster slots error. " + err.Error())
-		return
+		return protocolError("cluster slots error. " + err.Error())
 	}
+	atomic.AddUint64(&p.slotRefreshes, 1)
 
-	p.addrList = make([]string, 0)
+	addrList := make([]string, 0)
+	replicas := make(map[string][]string)
 
 	addrDone := make(map[string]bool)
+	// slots moved to new nodes, applied at once
+	moved := make(map[int64]string)
 
 	for _, slots := range reply.([]interface{}) {
 		slotsData := slots.([]interface{})
@@ -120,133 +392,209 @@ func (p *proxy) initSlotMap() {
 
 		// add node address to proxy.addrList
 		isNew := true
-		for _, addr := range p.addrList {
+		for _, addr := range addrList {
 			if tmpAddr == addr {
 				isNew = false
 				break
 			}
 		}
 		if isNew {
-			p.addrList = append(p.addrList, tmpAddr)
+			addrList = append(addrList, tmpAddr)
+		}
+
+		// replicas follow the master in each entry
+		if _, ok := replicas[tmpAddr]; !ok {
+			replicas[tmpAddr] = make([]string, 0)
+			for _, replica := range slotsData[3:] {
+				replica_tmp := replica.([]interface{})
+				replicaAddr := string(replica_tmp[0].([]uint8)) + ":" + strconv.FormatInt(replica_tmp[1].(int64), 10)
+				replicas[tmpAddr] = append(replicas[tmpAddr], replicaAddr)
+				if p.config().ReadPolicy != ReadMaster {
+					p.getBackend(replicaAddr)
+				}
+			}
 		}
 
 		for i := slot_from; i <= slot_to; i++ {
+			p.slotMapMutex.RLock()
+			oldAddr := p.slotMap[i]
+			p.slotMapMutex.RUnlock()
 			// When slot migrated
-			if p.slotMap[i] != tmpAddr {
+			if oldAddr != tmpAddr {
 				// Many slots may mapped to the same backend,
 				// calling initBackendByAddr only once is enough
 				if _, ok := addrDone[tmpAddr]; !ok {
 					p.initBackendByAddr(tmpAddr)
 					addrDone[tmpAddr] = true
 				}
-				if p.slotMap[i] != "" {
-					log.Println("slot migrated, id:", i, "from:", p.slotMap[i], "to:", tmpAddr)
+				if oldAddr != "" {
+					log.Println("slot migrated, id:", i, "from:", oldAddr, "to:", tmpAddr)
 				}
-				p.slotMapMutex.Lock()
-				p.slotMap[i] = tmpAddr
-				p.slotMapMutex.Unlock()
+				moved[i] = tmpAddr
 			}
 		}
 	}
+
+	// a node losing any slots counts once for a refresh, see scanDo
+	p.slotMapMutex.Lock()
+	losers := make(map[string]bool)
+	for i, addr := range moved {
+		if oldAddr := p.slotMap[i]; oldAddr != "" {
+			losers[oldAddr] = true
+		}
+		p.slotMap[i] = addr
+	}
+	for addr := range losers {
+		p.slotLosses[addr]++
+	}
+	if len(moved) > 0 {
+		atomic.AddUint64(&p.slotVersion, 1)
+	}
+	if strings.Join(p.addrList, ",") != strings.Join(addrList, ",") {
+		log.Println("cluster nodes:", addrList)
+	}
+	p.addrList = addrList
+	p.replicas = replicas
+	p.slotMapMutex.Unlock()
+	return nil
 }
 
 // initBackendByAddr init connections to a node, it may by triggered by many routines,
 // so use mutex for concurrency safe
-func (p *proxy) initBackendByAddr(addr string) {
+func (p *proxy) initBackendByAddr(addr string) *backend {
 	p.backendLock.Lock()
-	if _, ok := p.backend[addr]; !ok {
-		log.Println("cluster nodes:", p.addrList)
-		log.Println("init backend connection to", addr, ", pool size", p.chanSize)
-		p.backend[addr] = make(chan RedisConn, p.chanSize)
-		for i := 0; i < p.chanSize; i++ {
-			conn, err := net.Dial("tcp", addr)
-			if err != nil {
-				log.Fatal("failed to dail node " + addr + " " + err.Error())
-			}
-			c := NewConn(conn, 10, 10)
-			p.backend[addr] <- c
-		}
+	defer p.backendLock.Unlock()
+	b, ok := p.backend[addr]
+	if !ok {
+		log.Println("init backend connection to", addr, ", pool size", p.config().PoolSize)
+		b = newBackend(addr, p.config().PoolSize, RESP2, p.poolConn)
+		p.backend[addr] = b
 	}
+	return b
+}
+
+// getBackend return the backend of addr, init it if not exist
+func (p *proxy) getBackend(addr string) *backend {
+	p.backendLock.Lock()
+	b, ok := p.backend[addr]
 	p.backendLock.Unlock()
+	if ok {
+		return b
+	}
+	return p.initBackendByAddr(addr)
 }
 
 // checkBackendByAddr check all **KNOWN** connections to all nodes are healthy,
 // triggered by periodly keepalive()
 func (p *proxy) checkBackendByAddr(addr string) {
-	for i := 0; i < p.chanSize; i++ {
-		conn := <-p.backend[addr]
-		if err := conn.ping(); err == nil {
-			p.backend[addr] <- conn
-			continue
-		}
-		log.Println("connection to ", addr, " failed, replace with new one")
-		conn1, err := net.Dial("tcp", addr)
-		if err != nil {
-			log.Fatal("failed to dail node " + addr + " " + err.Error())
-		}
-		c := NewConn(conn1, 10, 10)
-		p.backend[addr] <- c
-	}
+	p.getBackend(addr).check(p.config().pingTimeout())
 }
 
-func (p *proxy) keepalive() {
-	for true {
-		time.Sleep(5 * time.Second)
-		for _, addr := range p.addrList {
-			p.checkBackendByAddr(addr)
+// updateSlot point slot to addr after a MOVED error, the whole slot map is
+// refreshed in background since other slots are likely moved too
+func (p *proxy) updateSlot(slot uint16, addr string) {
+	p.slotMapMutex.Lock()
+	oldAddr := p.slotMap[slot]
+	p.slotMap[slot] = addr
+	if oldAddr != addr {
+		atomic.AddUint64(&p.slotVersion, 1)
+		if oldAddr != "" {
+			p.slotLosses[oldAddr]++
 		}
-		p.initSlotMap()
+	}
+	p.slotMapMutex.Unlock()
+	if oldAddr != addr {
+		log.Println("slot moved, id:", slot, "from:", oldAddr, "to:", addr)
+		p.triggerRefresh()
 	}
 }
 
-func (p *proxy) exec(cmd []byte, addr string, ask bool) ([]byte, error) {
-	// Make sure there are available connection to `addr`
-	if _, ok := p.backend[addr]; !ok {
-		p.initBackendByAddr(addr)
+// triggerRefresh ask keepalive() to refresh slot map, never blocks
+func (p *proxy) triggerRefresh() {
+	select {
+	case p.refreshCh <- struct{}{}:
+	default:
 	}
+}
 
-	conn := <-p.backend[addr]
-
-	if ask {
-		conn.writeCmd("ASKING")
-		if _, err := conn.readReply(); err != nil {
-			conn.clear()
-			p.backend[addr] <- conn
-			return nil, protocolError("ASKING failed " + err.Error())
+// keepalive check backends periodically, and refresh slot map periodically or when
+// triggered. It's the only routine using adminConn after init
+func (p *proxy) keepalive() {
+	ticker := time.NewTicker(KEEPALIVE)
+	defer close(p.keepaliveDone)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.backendLock.Lock()
+			addrs := make([]string, 0, len(p.backend))
+			for addr := range p.backend {
+				addrs = append(addrs, addr)
+			}
+			p.backendLock.Unlock()
+			for _, addr := range addrs {
+				p.checkBackendByAddr(addr)
+			}
+		case <-p.refreshCh:
+			// MOVED errors come in bursts during resharding, refresh once for all of them
+			time.Sleep(REFRESHDELAY)
+			select {
+			case <-p.refreshCh:
+			default:
+			}
+		}
+		if p.adminConn == nil || p.adminConn.ping() != nil {
+			if err := p.reconnectAdmin(); err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+		if err := p.initSlotMap(); err != nil {
+			log.Println(err)
 		}
-		conn.clear()
 	}
+}
 
-	conn.writeBytes(cmd)
-	_, err := conn.readReply()
-	resp := conn.getResponse()
-	conn.clear()
-	p.backend[addr] <- conn
-	return resp, err
+// exec send cmd to node `addr`, the connection is shared with other sessions,
+// slot decides which of the pipelined connections is used, proto is the protocol
+// of the reply, fw is set if cmd is forwarded from a client
+func (p *proxy) exec(cmd []byte, addr string, slot uint16, ask bool, proto int, fw *forwarding) ([]byte, error) {
+	return p.getBackend(addr).do(cmd, slot, ask, proto, fw)
 }
 
-func (p *proxy) execNoAsk(cmd []byte, addr string) ([]byte, error) {
-	return p.exec(cmd, addr, false)
+// execNoAsk send cmd whose reply is parsed by proxy, in RESP2
+func (p *proxy) execNoAsk(cmd []byte, addr string, slot uint16) ([]byte, error) {
+	return p.exec(cmd, addr, slot, false, RESP2, nil)
 }
 
-func (p *proxy) execWithAsk(cmd []byte, addr string) ([]byte, error) {
-	return p.exec(cmd, addr, true)
+// nodeAddr return address of the master serving slot, empty if slot is not served
+func (p *proxy) nodeAddr(slot uint16) string {
+	p.slotMapMutex.RLock()
+	defer p.slotMapMutex.RUnlock()
+	return p.slotMap[slot]
 }
 
 func (p *proxy) do(cmd []byte) ([]byte, error) {
-	return p.slotDo(cmd, 0)
+	return p.slotDo(cmd, 0, RESP2)
 }
 
-func (p *proxy) slotDo(cmd []byte, id uint16) ([]byte, error) {
+func (p *proxy) slotDo(cmd []byte, id uint16, proto int) ([]byte, error) {
 	if !(id >= 0 && id < SLOTSIZE) {
-		return nil, protocolError("slot id out of range: " + string(id))
+		return nil, protocolError("slot id out of range: " + strconv.Itoa(int(id)))
 	}
 
-	p.slotMapMutex.RLock()
-	addr := p.slotMap[id]
-	p.slotMapMutex.RUnlock()
+	return p.slotDoAt(cmd, id, p.nodeAddr(id), proto, nil)
+}
 
-	resp, err := p.execNoAsk(cmd, addr)
+// slotDoAt send cmd of slot `id` to node `addr`, following MOVED and ASK
+func (p *proxy) slotDoAt(cmd []byte, id uint16, addr string, proto int, fw *forwarding) ([]byte, error) {
+	if addr == "" {
+		return nil, clusterDownError("")
+	}
+
+	resp, err := p.exec(cmd, addr, id, false, proto, fw)
 	if err == nil {
 		return resp, nil
 	}
@@ -254,11 +602,14 @@ func (p *proxy) slotDo(cmd []byte, id uint16) ([]byte, error) {
 	switch errVal := err.(type) {
 	case *movedError:
 		// get MOVED error for the first time, follow new address, update slot mapping
-		resp, err := p.execNoAsk(cmd, errVal.Address)
+		atomic.AddUint64(&p.movedCount, 1)
+		p.updateSlot(id, errVal.Address)
+		resp, err := p.exec(cmd, errVal.Address, id, false, proto, fw)
 		switch errVal := err.(type) {
 		case *askError:
 			// ASK error after MOVED error, follow new address
-			return p.execWithAsk(cmd, errVal.Address)
+			atomic.AddUint64(&p.askCount, 1)
+			return p.exec(cmd, errVal.Address, id, true, proto, fw)
 		case *movedError:
 			// MOVED error after MOVED error, this shouldn't happen
 			return nil, protocolError("Error! MOVED after MOVED")
@@ -267,13 +618,62 @@ func (p *proxy) slotDo(cmd []byte, id uint16) ([]byte, error) {
 		}
 	case *askError:
 		// get ASK error for the first time, follow new address
-		return p.execWithAsk(cmd, errVal.Address)
+		atomic.AddUint64(&p.askCount, 1)
+		return p.exec(cmd, errVal.Address, id, true, proto, fw)
 	default:
 		return resp, errVal
 	}
 }
 
+// masters return addresses of all masters
+func (p *proxy) masters() []string {
+	p.slotMapMutex.RLock()
+	defer p.slotMapMutex.RUnlock()
+	return append([]string{}, p.addrList...)
+}
+
+// broadcastDo send cmd to all masters concurrently, replies are in the order of
+// masters, the first error is returned if any node fails
+func (p *proxy) broadcastDo(cmd []byte) ([]interface{}, error) {
+	return p.broadcastTo(p.masters(), cmd)
+}
+
+// broadcastTo send cmd to addrs concurrently, replies are in the order of addrs
+func (p *proxy) broadcastTo(addrs []string, cmd []byte) ([]interface{}, error) {
+	results := make([]subResult, len(addrs))
+	var wg sync.WaitGroup
+	for n, addr := range addrs {
+		wg.Add(1)
+		go func(n int, addr string) {
+			defer wg.Done()
+			resp, err := p.execNoAsk(cmd, addr, 0)
+			if err != nil {
+				results[n] = subResult{nil, err}
+				return
+			}
+			reply, err := parseReply(resp)
+			results[n] = subResult{reply, err}
+		}(n, addr)
+	}
+	wg.Wait()
+
+	replies := make([]interface{}, len(addrs))
+	for n, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		replies[n] = r.reply
+	}
+	return replies, nil
+}
+
+const (
+	KEEPALIVE    = 5 * time.Second
+	REFRESHDELAY = 100 * time.Millisecond
+)
+
 const (
-	SLOTSIZE   = 16384
-	BACKENSIZE = 4
+	SLOTSIZE     = 16384
+	BACKENSIZE   = 4
+	PIPELINESIZE = 256
 )
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// subscription holds pub/sub state of a session. Subscriptions go through dedicated
+// connections, messages pushed by nodes are streamed back to the client.
+// Pub/sub commands are executed in order, so the state needs no lock
+type subscription struct {
+	channels map[string]bool
+	patterns map[string]bool
+	// shard channel => address of the node subscribed on
+	shardChannels map[string]string
+	// connection for SUBSCRIBE and PSUBSCRIBE
+	conn RedisConn
+	// connections for SSUBSCRIBE by node address
+	shardConns map[string]RedisConn
+	pumps      sync.WaitGroup
+	// connections of CLIENT TRACKING and the ones stopped, guarded by lock
+	trackConns []RedisConn
+	stopped    map[RedisConn]bool
+	closing    bool
+	lock       sync.Mutex
+}
+
+func newSubscription() *subscription {
+	return &subscription{
+		channels:      make(map[string]bool),
+		patterns:      make(map[string]bool),
+		shardChannels: make(map[string]string),
+		shardConns:    make(map[string]RedisConn),
+		stopped:       make(map[RedisConn]bool),
+	}
+}
+
+// active tell if the session is in subscriber mode
+func (sub *subscription) active() bool {
+	return len(sub.channels)+len(sub.patterns)+len(sub.shardChannels) > 0
+}
+
+// tracking tell if CLIENT TRACKING is on
+func (sub *subscription) tracking() bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return len(sub.trackConns) > 0
+}
+
+// stopTracking close connections of CLIENT TRACKING, their pumps exit quietly
+func (sub *subscription) stopTracking() {
+	sub.lock.Lock()
+	conns := sub.trackConns
+	sub.trackConns = nil
+	for _, conn := range conns {
+		sub.stopped[conn] = true
+	}
+	sub.lock.Unlock()
+	for _, conn := range conns {
+		conn.close()
+	}
+}
+
+// allowedInSubscribe are commands allowed in subscriber mode
+var allowedInSubscribe = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// pubsubDo handle pub/sub commands, replies of (un)subscribe come from pumps
+func (sess *session) pubsubDo(proxy Proxy, req *request) ([]byte, error) {
+	sub := sess.sub
+	switch req.name {
+	case "PUBLISH":
+		// PUBLISH propagates cluster-wide, any node works, spread by channel
+		return proxy.slotDo(req.raw, KeySlot(req.args[0]), sess.proto)
+	case "SPUBLISH":
+		return proxy.slotDo(req.raw, KeySlot(req.args[0]), sess.proto)
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if sub.conn == nil {
+			conn, err := sess.subscribeConn(proxy, proxy.nodeAddr(KeySlot(req.args[0])))
+			if err != nil {
+				return nil, err
+			}
+			sub.conn = conn
+		}
+		set := sub.channels
+		if req.name == "PSUBSCRIBE" {
+			set = sub.patterns
+		}
+		for _, arg := range req.args {
+			set[string(arg)] = true
+		}
+		return nil, sub.conn.writeBytes(req.raw)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		if sub.conn == nil {
+			return unsubscribeReply(req.name, req.args, sess.proto), nil
+		}
+		set := sub.channels
+		if req.name == "PUNSUBSCRIBE" {
+			set = sub.patterns
+		}
+		if len(req.args) == 0 {
+			for ch := range set {
+				delete(set, ch)
+			}
+		}
+		for _, arg := range req.args {
+			delete(set, string(arg))
+		}
+		return nil, sub.conn.writeBytes(req.raw)
+	case "SSUBSCRIBE":
+		slot := keysSlot(req.keys)
+		if slot < 0 {
+			return nil, protocolError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+		addr := proxy.nodeAddr(uint16(slot))
+		if addr == "" {
+			return nil, clusterDownError("")
+		}
+		conn, ok := sub.shardConns[addr]
+		if !ok {
+			var err error
+			if conn, err = sess.subscribeConn(proxy, addr); err != nil {
+				return nil, err
+			}
+			sub.shardConns[addr] = conn
+		}
+		for _, arg := range req.args {
+			sub.shardChannels[string(arg)] = addr
+		}
+		return nil, conn.writeBytes(req.raw)
+	case "SUNSUBSCRIBE":
+		if len(req.args) == 0 {
+			if len(sub.shardConns) == 0 {
+				return unsubscribeReply(req.name, req.args, sess.proto), nil
+			}
+			for ch := range sub.shardChannels {
+				delete(sub.shardChannels, ch)
+			}
+			for _, conn := range sub.shardConns {
+				if err := conn.writeBytes(req.raw); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+		if keysSlot(req.keys) < 0 {
+			return nil, protocolError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+		// channels of a slot are on different nodes if it moved between SSUBSCRIBEs
+		groups := make(map[string][][]byte)
+		unknown := make([][]byte, 0)
+		for _, arg := range req.args {
+			addr, ok := sub.shardChannels[string(arg)]
+			if !ok {
+				unknown = append(unknown, arg)
+				continue
+			}
+			groups[addr] = append(groups[addr], arg)
+			delete(sub.shardChannels, string(arg))
+		}
+		if len(groups) == 0 {
+			return unsubscribeReply(req.name, req.args, sess.proto), nil
+		}
+		// channels not subscribed are replied by any of the nodes
+		for addr, channels := range groups {
+			cmd := append([][]byte{[]byte(req.name)}, channels...)
+			cmd = append(cmd, unknown...)
+			unknown = nil
+			if err := sub.shardConns[addr].writeBytes(encodeCmd(cmd)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return nil, protocolError("unsupported cmd " + req.name)
+}
+
+// subscribeConn dial a dedicated connection and start pumping messages from it
+func (sess *session) subscribeConn(proxy Proxy, addr string) (RedisConn, error) {
+	if addr == "" {
+		return nil, clusterDownError("")
+	}
+	conn, err := proxy.dedicatedConn(addr, 0, sess.proto)
+	if err != nil {
+		return nil, dialError(addr, err)
+	}
+	sess.sub.pumps.Add(1)
+	go sess.pump(conn)
+	return conn, nil
+}
+
+// pump stream replies and messages of a subscribe connection to the client through
+// the reply queue, so they never overtake replies of requests before them
+func (sess *session) pump(conn RedisConn) {
+	defer sess.sub.pumps.Done()
+	for {
+		resp, err := conn.readRaw()
+		if err != nil && !isReplyError(err) {
+			sess.sub.lock.Lock()
+			closing := sess.sub.closing || sess.sub.stopped[conn]
+			delete(sess.sub.stopped, conn)
+			sess.sub.lock.Unlock()
+			if !closing {
+				// subscriptions are lost, close the client so it subscribes again
+				log.Println("subscribe connection to", conn.remoteAddr(), "broken,", err)
+				sess.cliConn.close()
+			}
+			return
+		}
+		push := &request{
+			resp: resp,
+			slot: -1,
+			done: closedChan,
+		}
+		atomic.AddInt64(&sess.unreplied, 1)
+		sess.pending <- push
+	}
+}
+
+// close dedicated connections and wait for pumps to exit
+func (sub *subscription) close() {
+	sub.lock.Lock()
+	sub.closing = true
+	sub.lock.Unlock()
+	sub.stopTracking()
+	if sub.conn != nil {
+		sub.conn.close()
+	}
+	for _, conn := range sub.shardConns {
+		conn.close()
+	}
+	sub.pumps.Wait()
+}
+
+// unsubscribeReply is the reply of unsubscribe when the session subscribes nothing,
+// it's pushed in RESP3
+func unsubscribeReply(cmd string, channels [][]byte, proto int) []byte {
+	name := []byte(strings.ToLower(cmd))
+	reply := func(ch []byte) []byte {
+		if proto == RESP3 {
+			return encodeReply(respPush{name, ch, int64(0)})
+		}
+		return encodeReply([]interface{}{name, ch, int64(0)})
+	}
+	if len(channels) == 0 {
+		return reply(nil)
+	}
+	resp := make([]byte, 0)
+	for _, ch := range channels {
+		resp = append(resp, reply(ch)...)
+	}
+	return resp
+}
+
+// subscribePing is the reply of PING in subscriber mode
+func subscribePing(args [][]byte) []byte {
+	msg := []byte{}
+	if len(args) > 0 {
+		msg = args[0]
+	}
+	return encodeReply([]interface{}{[]byte("pong"), msg})
+}
+
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitConfig limits requests per second by token buckets, a burst of one
+// second of requests is allowed. 0 means unlimited
+type RateLimitConfig struct {
+	// requests of all clients
+	Global int `toml:"global"`
+	// requests of each client IP
+	PerIP int `toml:"per_ip"`
+	// requests of each authenticated user
+	PerUser int `toml:"per_user"`
+	// requests of all clients by command class
+	Write int `toml:"write"`
+	Read  int `toml:"read"`
+	Admin int `toml:"admin"`
+	// how long a request may wait for tokens before it's rejected, in millisecond
+	MaxWait int `toml:"max_wait"`
+}
+
+func (r *RateLimitConfig) valid() bool {
+	return r.Global >= 0 && r.PerIP >= 0 && r.PerUser >= 0 &&
+		r.Write >= 0 && r.Read >= 0 && r.Admin >= 0 && r.MaxWait >= 0
+}
+
+// names of limits, requests rejected are counted by them
+var limitNames = []string{"global", "ip", "user", "write", "read", "admin"}
+
+var rateLimited = make(map[string]*uint64)
+
+func init() {
+	for _, name := range limitNames {
+		rateLimited[name] = new(uint64)
+	}
+}
+
+// BUCKETSWEEP is how often buckets of clients and users are swept once they're full
+const BUCKETSWEEP = time.Minute
+
+type tokenBucket struct {
+	// tokens per second, also the capacity
+	rate float64
+	// negative when requests wait for tokens
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// refill add tokens since the last refill, should be called with lock held
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take a token, return how long to wait until it's available. The token is not
+// taken if the wait is longer than max
+func (b *tokenBucket) take(now time.Time, max time.Duration) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > max {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// refund a token taken for a request rejected by another limit
+func (b *tokenBucket) refund() {
+	b.lock.Lock()
+	b.tokens++
+	b.lock.Unlock()
+}
+
+// full tell if the bucket is the same as a new one
+func (b *tokenBucket) full(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return b.tokens >= b.rate
+}
+
+// bucketMap holds a bucket for each client IP or user, full buckets are swept
+type bucketMap struct {
+	rate    int
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	lock    sync.Mutex
+}
+
+func newBucketMap(rate int) *bucketMap {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucketMap{rate: rate, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+func (m *bucketMap) get(key string, now time.Time) *tokenBucket {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.swept) > BUCKETSWEEP {
+		for k, b := range m.buckets {
+			if b.full(now) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = newTokenBucket(m.rate, now)
+		m.buckets[key] = b
+	}
+	return b
+}
+
+// rateLimiter enforce limits of config, buckets are nil for unlimited ones
+type rateLimiter struct {
+	global  *tokenBucket
+	write   *tokenBucket
+	read    *tokenBucket
+	admin   *tokenBucket
+	ips     *bucketMap
+	users   *bucketMap
+	maxWait time.Duration
+}
+
+// newRateLimiter return nil if nothing is limited
+func newRateLimiter(conf *RateLimitConfig) *rateLimiter {
+	if *conf == (RateLimitConfig{MaxWait: conf.MaxWait}) {
+		return nil
+	}
+	now := time.Now()
+	bucket := func(rate int) *tokenBucket {
+		if rate <= 0 {
+			return nil
+		}
+		return newTokenBucket(rate, now)
+	}
+	return &rateLimiter{
+		global:  bucket(conf.Global),
+		write:   bucket(conf.Write),
+		read:    bucket(conf.Read),
+		admin:   bucket(conf.Admin),
+		ips:     newBucketMap(conf.PerIP),
+		users:   newBucketMap(conf.PerUser),
+		maxWait: time.Duration(conf.MaxWait) * time.Millisecond,
+	}
+}
+
+// take a token from every bucket the request is subject to, return how long to wait
+// until all tokens are available. user is empty if the client isn't authenticated,
+// flags are flags of the command
+func (l *rateLimiter) take(ip string, user string, flags int) (time.Duration, error) {
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0, 4)
+	names := make([]string, 0, 4)
+	add := func(b *tokenBucket, name string) {
+		if b != nil {
+			buckets = append(buckets, b)
+			names = append(names, name)
+		}
+	}
+	add(l.global, "global")
+	switch {
+	case flags&CmdAdmin != 0:
+		add(l.admin, "admin")
+	case flags&CmdWrite != 0:
+		add(l.write, "write")
+	case flags&CmdReadonly != 0:
+		add(l.read, "read")
+	}
+	if l.ips != nil {
+		add(l.ips.get(ip, now), "ip")
+	}
+	if l.users != nil && user != "" {
+		add(l.users.get(user, now), "user")
+	}
+
+	var longest time.Duration
+	for i, b := range buckets {
+		wait, ok := b.take(now, l.maxWait)
+		if !ok {
+			for _, taken := range buckets[:i] {
+				taken.refund()
+			}
+			atomic.AddUint64(rateLimited[names[i]], 1)
+			return 0, redisError("ERR rate limited, " + names[i] + " limit exceeded")
+		}
+		if wait > longest {
+			longest = wait
+		}
+	}
+	return longest, nil
+}
+
+// hostOf return the host of addr, or addr if it has no port
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// rateLimit wait for tokens of limits the request is subject to, the request is
+// rejected if they're not available in max_wait. Requests after it are not read
+// while it's waiting
+func (sess *session) rateLimit(proxy Proxy, req *request) error {
+	l := proxy.getRateLimiter()
+	if l == nil {
+		return nil
+	}
+	user := ""
+	if u, _ := sess.user.Load().(*aclUser); u != nil {
+		user = u.name
+	}
+	flags := 0
+	if req.cmd != nil {
+		flags = req.cmd.flags
+	}
+	wait, err := l.take(sess.ip, user, flags)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
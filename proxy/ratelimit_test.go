@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	begin := time.Now()
+	type step struct {
+		// time since the bucket is created
+		at  time.Duration
+		max time.Duration
+		// wait returned by take and whether the token is taken
+		wait time.Duration
+		ok   bool
+	}
+	tests := []struct {
+		name  string
+		rate  int
+		steps []step
+	}{
+		{"burst of one second", 2, []step{
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 500 * time.Millisecond, false},
+		}},
+		{"refilled by elapsed time", 2, []step{
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{250 * time.Millisecond, 0, 250 * time.Millisecond, false},
+			{500 * time.Millisecond, 0, 0, true},
+		}},
+		{"capped at rate", 2, []step{
+			{10 * time.Second, 0, 0, true},
+			{10 * time.Second, 0, 0, true},
+			{10 * time.Second, 0, 500 * time.Millisecond, false},
+		}},
+		{"waiting requests take tokens ahead", 10, []step{
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, 0, 0, true},
+			{0, time.Second, 100 * time.Millisecond, true},
+			{0, time.Second, 200 * time.Millisecond, true},
+			{0, 100 * time.Millisecond, 300 * time.Millisecond, false},
+			{300 * time.Millisecond, 0, 0, true},
+		}},
+		{"clock going back", 1, []step{
+			{time.Second, 0, 0, true},
+			{0, 0, time.Second, false},
+			{2 * time.Second, 0, 0, true},
+		}},
+	}
+	for _, test := range tests {
+		b := newTokenBucket(test.rate, begin)
+		for i, s := range test.steps {
+			wait, ok := b.take(begin.Add(s.at), s.max)
+			// float rounding may lose a nanosecond
+			if diff := wait - s.wait; ok != s.ok || diff > time.Microsecond || diff < -time.Microsecond {
+				t.Errorf("%s: step %d got %v %v, want %v %v", test.name, i, wait, ok, s.wait, s.ok)
+			}
+		}
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	begin := time.Now()
+	b := newTokenBucket(4, begin)
+	if !b.full(begin) {
+		t.Error("new bucket is not full")
+	}
+	b.take(begin, 0)
+	b.take(begin, 0)
+	if b.full(begin.Add(250 * time.Millisecond)) {
+		t.Error("bucket full after refilled 1 of 2 tokens")
+	}
+	b.refund()
+	if !b.full(begin.Add(250 * time.Millisecond)) {
+		t.Error("bucket not full after refund")
+	}
+}
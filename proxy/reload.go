@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"log"
+	"reflect"
+)
+
+// Reload apply conf to the running proxy, sessions keep their connections. Users,
+// command rules and rate limits apply to the next request, connections to nodes are dialed
+// again if their options change. Options of listeners and backend TLS take effect
+// only after restart
+func (p *proxy) Reload(conf *Config) error {
+	if err := conf.Check(); err != nil {
+		return err
+	}
+	users, err := newACL(conf)
+	if err != nil {
+		return err
+	}
+	old := p.config()
+	restart := map[string][2]interface{}{
+		"listen":      {old.Listen, conf.Listen},
+		"tls":         {old.TLS, conf.TLS},
+		"backend_tls": {old.BackendTLS, conf.BackendTLS},
+		"metrics":     {old.Metrics, conf.Metrics},
+		"dashboard":   {old.Dashboard, conf.Dashboard},
+	}
+	for name, v := range restart {
+		if !reflect.DeepEqual(v[0], v[1]) {
+			log.Println("config:", name, "changed, it takes effect after restart")
+		}
+	}
+	conf.Listen, conf.TLS, conf.BackendTLS = old.Listen, old.TLS, old.BackendTLS
+	conf.Metrics, conf.Dashboard = old.Metrics, old.Dashboard
+
+	setCommandRules(conf.AllowCommands, conf.DenyCommands)
+	p.acl.Store(users)
+	p.limiter.Store(newRateLimiter(&conf.RateLimit))
+	p.conf.Store(conf)
+
+	redial := old.PoolSize != conf.PoolSize || old.DialTimeout != conf.DialTimeout ||
+		old.ReadTimeout != conf.ReadTimeout || old.WriteTimeout != conf.WriteTimeout ||
+		old.ReadPolicy != conf.ReadPolicy || old.BackendUser != conf.BackendUser ||
+		old.BackendPassword != conf.BackendPassword
+	if redial {
+		p.resetBackends()
+	}
+	// replicas are connected by refreshing slot map if reading from them is enabled
+	if old.ReadPolicy != conf.ReadPolicy {
+		p.triggerRefresh()
+	}
+	log.Println("config reloaded")
+	return nil
+}
+
+// resetBackends dial connections to nodes again with current config, idle connections
+// for blocking commands are closed
+func (p *proxy) resetBackends() {
+	p.backendLock.Lock()
+	backends := make([]*backend, 0, len(p.backend))
+	for _, b := range p.backend {
+		backends = append(backends, b)
+	}
+	p.backendLock.Unlock()
+	size := p.config().PoolSize
+	for _, b := range backends {
+		if err := b.reset(size); err != nil {
+			log.Println("reset connections to", b.addr, "failed, keep old ones.", err)
+		}
+	}
+
+	p.blockingLock.Lock()
+	idle := p.blockingIdle
+	p.blockingIdle = make(map[blockingKey][]RedisConn)
+	p.blockingLock.Unlock()
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.close()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+// read policies decide which node serves read-only commands
+const (
+	// always read from master
+	ReadMaster = "master"
+	// read from replicas, fall back to master if no replica is healthy
+	ReadPreferReplica = "prefer-replica"
+	// read from master and replicas in turn
+	ReadRoundRobin = "round-robin"
+	// read from the node with lowest ping latency
+	ReadLowestLatency = "lowest-latency"
+)
+
+func validReadPolicy(policy string) bool {
+	switch policy {
+	case ReadMaster, ReadPreferReplica, ReadRoundRobin, ReadLowestLatency:
+		return true
+	}
+	return false
+}
+
+// readSlotDo send a read-only cmd to the node picked by read policy
+func (p *proxy) readSlotDo(cmd []byte, id uint16, proto int) ([]byte, error) {
+	if id >= SLOTSIZE {
+		return p.slotDo(cmd, id, proto)
+	}
+	return p.slotDoAt(cmd, id, p.readAddr(id), proto, nil)
+}
+
+// readAddr pick the node to read slot from by read policy
+func (p *proxy) readAddr(slot uint16) string {
+	p.slotMapMutex.RLock()
+	master := p.slotMap[slot]
+	replicas := p.replicas[master]
+	p.slotMapMutex.RUnlock()
+
+	policy := p.config().ReadPolicy
+	if policy == ReadMaster || len(replicas) == 0 {
+		return master
+	}
+
+	var candidates []*backend
+	if policy == ReadPreferReplica {
+		candidates = p.healthyBackends(replicas)
+	} else {
+		candidates = p.healthyBackends(append([]string{master}, replicas...))
+	}
+	if len(candidates) == 0 {
+		return master
+	}
+
+	if policy == ReadLowestLatency {
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if b.getLatency() < best.getLatency() {
+				best = b
+			}
+		}
+		return best.addr
+	}
+	n := atomic.AddUint64(&p.readCounter, 1)
+	return candidates[n%uint64(len(candidates))].addr
+}
+
+// healthyBackends return backends of addrs which are initialized and healthy
+func (p *proxy) healthyBackends(addrs []string) []*backend {
+	backends := make([]*backend, 0, len(addrs))
+	p.backendLock.Lock()
+	for _, addr := range addrs {
+		if b, ok := p.backend[addr]; ok {
+			backends = append(backends, b)
+		}
+	}
+	p.backendLock.Unlock()
+
+	healthy := backends[:0]
+	for _, b := range backends {
+		if b.healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// INHERITENV is the environment variable telling a new process the fd of the
+// listener inherited from its parent on hot restart, METRICSENV is the one of the
+// metrics listener
+const (
+	INHERITENV = "PROXY_INHERIT_FD"
+	METRICSENV = "PROXY_INHERIT_METRICS_FD"
+)
+
+// inherited is true if the listener comes from the parent process
+var inherited bool
+
+// listenTCP listen on addr, or use the listener inherited from the parent process
+func listenTCP(addr string) (net.Listener, error) {
+	ln, err := inheritListener(INHERITENV)
+	if ln != nil || err != nil {
+		inherited = ln != nil
+		return ln, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenMetrics listen on addr of metrics, or use the listener inherited from the
+// parent process, which keeps serving metrics until it exits
+func ListenMetrics(addr string) (net.Listener, error) {
+	ln, err := inheritListener(METRICSENV)
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// inheritListener return the listener whose fd is in environment variable env,
+// nil if it's not set
+func inheritListener(env string) (net.Listener, error) {
+	fd := os.Getenv(env)
+	if fd == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, protocolError("bad " + env + " " + fd)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Restart start a new process of the same binary and arguments, it inherits the
+// listener so clients are never refused, and the metrics listener if it's not nil.
+// The parent keeps serving until the new process calls TakeOver
+func Restart(ln net.Listener, metrics net.Listener) (*os.Process, error) {
+	// files are dups of listeners, closing them doesn't close the listeners
+	f, err := listenerFile(ln)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	// fd 3 is the first of extra files after stdin, stdout and stderr
+	env := append(os.Environ(), INHERITENV+"=3")
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, f}
+	if metrics != nil {
+		mf, err := listenerFile(metrics)
+		if err != nil {
+			return nil, err
+		}
+		defer mf.Close()
+		env = append(env, METRICSENV+"=4")
+		files = append(files, mf)
+	}
+	return os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+}
+
+func listenerFile(ln net.Listener) (*os.File, error) {
+	l, ok := ln.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, protocolError("listener can't be inherited")
+	}
+	return l.File()
+}
+
+// TakeOver tell the parent process to drain, if the listener is inherited from it
+func TakeOver() error {
+	if !inherited {
+		return nil
+	}
+	return syscall.Kill(os.Getppid(), syscall.SIGTERM)
+}
+
+// tlsListener keep the tcp listener under TLS, so it can be inherited
+type tlsListener struct {
+	net.Listener
+	tcp *net.TCPListener
+}
+
+func (l *tlsListener) File() (*os.File, error) {
+	if l.tcp == nil {
+		return nil, protocolError("listener can't be inherited")
+	}
+	return l.tcp.File()
+}
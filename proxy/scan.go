@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"strconv"
+)
+
+// scanNode is a master in scan order, nodes are ordered by the lowest slot they own
+type scanNode struct {
+	addr    string
+	minSlot uint16
+	// times the node lost slots
+	losses uint64
+}
+
+// scanNodes return masters ordered by their lowest slot
+func (p *proxy) scanNodes() []scanNode {
+	p.slotMapMutex.RLock()
+	defer p.slotMapMutex.RUnlock()
+	nodes := make([]scanNode, 0)
+	seen := make(map[string]bool)
+	for slot, addr := range p.slotMap {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, scanNode{addr, uint16(slot), p.slotLosses[addr]})
+		}
+	}
+	return nodes
+}
+
+// SCANLOSSBITS is how many low bits of the losses of a node a cursor carries
+const SCANLOSSBITS = 10
+
+// encodeScanCursor pack the cursor of a node with a slot of the node and the times
+// the node lost slots, `node cursor << 24 | losses << 14 | slot`
+func encodeScanCursor(nodeCursor uint64, slot uint16, losses uint64) uint64 {
+	losses &= 1<<SCANLOSSBITS - 1
+	return nodeCursor<<(14+SCANLOSSBITS) | losses<<14 | uint64(slot)
+}
+
+// decodeScanCursor unpack a cursor made by encodeScanCursor
+func decodeScanCursor(cursor uint64) (nodeCursor uint64, slot uint16, losses uint64) {
+	return cursor >> (14 + SCANLOSSBITS), uint16(cursor & (SLOTSIZE - 1)), cursor >> 14 & (1<<SCANLOSSBITS - 1)
+}
+
+// findScanNode return the index of the node owning slot in nodes, -1 if the node
+// lost slots since the cursor was made, keys may have moved to a node already
+// scanned then
+func findScanNode(nodes []scanNode, owner string, losses uint64) int {
+	for i, node := range nodes {
+		if node.addr == owner {
+			if node.losses&(1<<SCANLOSSBITS-1) != losses {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// scanDo scan masters one by one. The cursor returned to client carries the
+// cursor of the node, a slot of the node to find it again and the times the node
+// lost slots. If the node lost slots since, keys may have moved to a node
+// already scanned, so the scan restarts from the first node and keys may be
+// returned twice. Slots moved between other nodes don't restart it. A loss is
+// missed only if the count wraps around exactly between two calls. Cursors are
+// only valid on the node which returned them, so scan never goes to replicas
+func (p *proxy) scanDo(args [][]byte) ([]byte, error) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, redisError("ERR invalid cursor")
+	}
+	nodes := p.scanNodes()
+	if len(nodes) == 0 {
+		return nil, clusterDownError("")
+	}
+
+	n := 0
+	nodeCursor, slot, losses := decodeScanCursor(cursor)
+	if cursor != 0 {
+		// the node may own a lower slot now, it's found by the slot it still owns
+		if n = findScanNode(nodes, p.nodeAddr(slot), losses); n < 0 {
+			n, nodeCursor = 0, 0
+		}
+	}
+
+	node := nodes[n]
+	cmd := append([][]byte{[]byte("SCAN"), []byte(strconv.FormatUint(nodeCursor, 10))}, args[1:]...)
+	resp, err := p.execNoAsk(encodeCmd(cmd), node.addr, node.minSlot)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := parseReply(resp)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, protocolError("bad SCAN reply from backend")
+	}
+	next, err := strconv.ParseUint(string(toBytes(values[0])), 10, 64)
+	if err != nil {
+		return nil, protocolError("bad SCAN cursor from backend")
+	}
+
+	// continue with the next node when this one is done
+	switch {
+	case next != 0:
+		cursor = encodeScanCursor(next, node.minSlot, node.losses)
+	case n+1 < len(nodes):
+		cursor = encodeScanCursor(0, nodes[n+1].minSlot, nodes[n+1].losses)
+	default:
+		cursor = 0
+	}
+	return encodeReply([]interface{}{[]byte(strconv.FormatUint(cursor, 10)), values[1]}), nil
+}
+
+// toBytes return bulk string or simple string reply as bytes
+func toBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestScanCursor(t *testing.T) {
+	tests := []struct {
+		nodeCursor uint64
+		slot       uint16
+		losses     uint64
+	}{
+		{0, 0, 0},
+		{0, 5461, 1},
+		{1, 0, 0},
+		{12345, 10923, 7},
+		{1<<40 - 1, SLOTSIZE - 1, 1<<SCANLOSSBITS - 1},
+	}
+	for _, test := range tests {
+		cursor := encodeScanCursor(test.nodeCursor, test.slot, test.losses)
+		nodeCursor, slot, losses := decodeScanCursor(cursor)
+		if nodeCursor != test.nodeCursor || slot != test.slot || losses != test.losses {
+			t.Errorf("%+v: decoded %d %d %d from %d", test, nodeCursor, slot, losses, cursor)
+		}
+	}
+
+	// only the low bits of the losses are kept
+	_, _, losses := decodeScanCursor(encodeScanCursor(3, 100, 1<<SCANLOSSBITS+2))
+	if losses != 2 {
+		t.Errorf("got losses %d, want 2", losses)
+	}
+	// the cursor of the next node is never 0, which ends the scan
+	if encodeScanCursor(0, 1, 0) == 0 {
+		t.Error("cursor of a node is 0")
+	}
+}
+
+func TestFindScanNode(t *testing.T) {
+	nodes := []scanNode{
+		{"127.0.0.1:7101", 0, 0},
+		{"127.0.0.1:7102", 5461, 3},
+		{"127.0.0.1:7103", 10923, 1<<SCANLOSSBITS + 1},
+	}
+	tests := []struct {
+		owner  string
+		losses uint64
+		want   int
+	}{
+		{"127.0.0.1:7101", 0, 0},
+		{"127.0.0.1:7102", 3, 1},
+		// only the low bits of the losses are carried by the cursor
+		{"127.0.0.1:7103", 1, 2},
+		// the node lost slots since the cursor was made
+		{"127.0.0.1:7102", 2, -1},
+		// the slot of the cursor is not served, or moved to a new node
+		{"", 0, -1},
+		{"127.0.0.1:7104", 0, -1},
+	}
+	for _, test := range tests {
+		if got := findScanNode(nodes, test.owner, test.losses); got != test.want {
+			t.Errorf("%s losses %d: got %d, want %d", test.owner, test.losses, got, test.want)
+		}
+	}
+}
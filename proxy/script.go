@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// scriptCache keeps bodies of scripts seen by EVAL and SCRIPT LOAD by sha1, so
+// EVALSHA can be retried on a node which doesn't have the script
+type scriptCache struct {
+	lock   sync.RWMutex
+	bodies map[string][]byte
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{bodies: make(map[string][]byte)}
+}
+
+func (sc *scriptCache) add(body []byte) {
+	sum := sha1.Sum(body)
+	sha := hex.EncodeToString(sum[:])
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if _, ok := sc.bodies[sha]; ok {
+		return
+	}
+	if len(sc.bodies) >= SCRIPTCACHESIZE {
+		// scripts are usually a few, drop any one
+		for k := range sc.bodies {
+			delete(sc.bodies, k)
+			break
+		}
+	}
+	sc.bodies[sha] = append([]byte{}, body...)
+}
+
+// get return nil if sha is unknown
+func (sc *scriptCache) get(sha string) []byte {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+	return sc.bodies[strings.ToLower(sha)]
+}
+
+func (sc *scriptCache) flush() {
+	sc.lock.Lock()
+	sc.bodies = make(map[string][]byte)
+	sc.lock.Unlock()
+}
+
+// evalDo send EVAL, EVALSHA and their read-only variants to the node owns their
+// keys. Scripts without key run on any node. EVALSHA got NOSCRIPT is retried as
+// EVAL with the cached body, which loads the script on that node again
+func (p *proxy) evalDo(cmd string, args [][]byte, keys [][]byte, readReplica bool, proto int) ([]byte, error) {
+	var slot uint16
+	if len(keys) == 0 {
+		// spread by script, so the same script goes to the same node
+		slot = KeySlot(args[0])
+	} else if s := keysSlot(keys); s >= 0 {
+		slot = uint16(s)
+	} else {
+		return nil, protocolError("CROSSSLOT Keys in script don't hash to the same slot")
+	}
+
+	slotDo := p.slotDo
+	if readReplica {
+		slotDo = p.readSlotDo
+	}
+	if cmd == "EVAL" || cmd == "EVAL_RO" {
+		p.scripts.add(args[0])
+	}
+
+	full := append([][]byte{[]byte(cmd)}, args...)
+	resp, err := slotDo(encodeCmd(full), slot, proto)
+	if cmd != "EVALSHA" && cmd != "EVALSHA_RO" {
+		return resp, err
+	}
+	if re, ok := err.(redisError); !ok || !strings.HasPrefix(string(re), "NOSCRIPT") {
+		return resp, err
+	}
+	body := p.scripts.get(string(args[0]))
+	if body == nil {
+		return resp, err
+	}
+	full[0] = []byte(strings.Replace(cmd, "EVALSHA", "EVAL", 1))
+	full[1] = body
+	return slotDo(encodeCmd(full), slot, proto)
+}
+
+// scriptDo broadcast SCRIPT LOAD, EXISTS and FLUSH to all masters and merge replies
+func (p *proxy) scriptDo(args [][]byte) ([]byte, error) {
+	sub := strings.ToUpper(string(args[0]))
+	switch sub {
+	case "LOAD", "EXISTS", "FLUSH":
+	default:
+		return nil, protocolError("unsupported cmd SCRIPT " + sub)
+	}
+
+	replies, err := p.broadcastDo(encodeCmd(append([][]byte{[]byte("SCRIPT")}, args...)))
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) == 0 {
+		return nil, clusterDownError("")
+	}
+
+	switch sub {
+	case "LOAD":
+		if len(args) == 2 {
+			p.scripts.add(args[1])
+		}
+		// every node replies the same sha1
+		return encodeReply(replies[0]), nil
+	case "EXISTS":
+		// a script exists only if all masters have it
+		merged := make([]interface{}, len(args)-1)
+		for i := range merged {
+			merged[i] = int64(1)
+		}
+		for _, reply := range replies {
+			values, ok := reply.([]interface{})
+			if !ok || len(values) != len(merged) {
+				return nil, protocolError("bad SCRIPT EXISTS reply from backend")
+			}
+			for i, v := range values {
+				if n, _ := v.(int64); n == 0 {
+					merged[i] = int64(0)
+				}
+			}
+		}
+		return encodeReply(merged), nil
+	default:
+		// scripts flushed on nodes must not come back by NOSCRIPT retries
+		p.scripts.flush()
+		return encodeReply(okReply), nil
+	}
+}
+
+const SCRIPTCACHESIZE = 4096
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,86 +15,465 @@ type Session interface {
 }
 
 type session struct {
+	id          uint64
 	ts          time.Time
 	ops         uint64
 	microsecond uint64
 	cliConn     RedisConn
 	closed      bool
+	// client IP, requests are rate limited by it
+	ip string
+	// client issued READWRITE, read-only commands always go to masters
+	readMaster bool
+	// requests read from client but not replied yet, in order
+	pending chan *request
+	// number of replies and pushed messages queued but not written yet
+	unreplied int64
+	// last in-flight request of each slot, requests to the same slot are
+	// queued to the node in order
+	inflight map[uint16]*request
+	// last request that must wait all requests before it
+	barrier *request
+	// unordered requests after the barrier, the next barrier waits for them
+	unordered []*request
+	// requests being executed
+	execs sync.WaitGroup
+	sub   *subscription
+	tx    *transaction
+	// reader has seen MULTI but not EXEC or DISCARD yet
+	queueing bool
+	// closed when client disconnects, blocking commands are cancelled
+	quit chan struct{}
+	// name set by CLIENT SETNAME
+	name     string
+	nameLock sync.Mutex
+	// when the last request is read, in nanosecond
+	lastActive int64
+	lastCmd    atomic.Value
+	// *aclUser authenticated by AUTH
+	user atomic.Value
+	// protocol negotiated by HELLO, HELLO waits for all requests before it and
+	// requests after it wait for HELLO, so it needs no lock
+	proto int
+}
+
+// request is a client request in the pipeline
+type request struct {
+	name string
+	args [][]byte
+	raw  []byte
+	// nil if command is unknown
+	cmd  *commandInfo
+	keys [][]byte
+	// slot of the request key, -1 if request is not bound to a single slot
+	slot int
+	resp []byte
+	err  error
+	done chan struct{}
+	// set if the reply is streamed from the node
+	stream *replyStream
+
+	// slots of a multi-key command whose keys hash to different slots
+	slots []uint16
+	// keyless read-only command, it doesn't wait for requests before it except barriers
+	unordered bool
+	// closed once the request is queued on connections of its slots, or done
+	queued    chan struct{}
+	queueOnce sync.Once
 }
 
 func NewSession(net net.Conn) Session {
-	conn := NewConn(net, 10, 10)
+	conn := NewConn(net, 0, 0)
 	return &session{
+		ip:          hostOf(conn.remoteAddr()),
 		ts:          time.Now(),
 		ops:         0,
 		microsecond: 0,
 		cliConn:     conn,
 		closed:      false,
+		pending:     make(chan *request, PIPELINESIZE),
+		inflight:    make(map[uint16]*request),
+		barrier:     nil,
+		sub:         newSubscription(),
+		tx:          newTransaction(),
+		quit:        make(chan struct{}),
+		lastActive:  time.Now().UnixNano(),
+		proto:       RESP2,
 	}
 }
 
+// Loop read requests from client without waiting for replies, requests are executed
+// concurrently and replies are written back by writeLoop in the order of requests
 func (sess *session) Loop(proxy Proxy) error {
 	log.Println("new session, remote:", sess.remoteAddr(), ", create at:", sess.ts.Format(time.Stamp))
+	registerSession(sess)
+	defer unregisterSession(sess)
+	writeDone := make(chan struct{})
+	go func() {
+		sess.writeLoop()
+		close(writeDone)
+	}()
+
+	var err error
 	for {
-		req_obj, err := sess.readReq()
+		var req *request
+		req, err = sess.readReq(proxy)
 		if err != nil {
-			sess.close(err)
-			return err
+			break
+		}
+		if req.name == "QUIT" {
+			sess.closed = true
+			err = protocolError("client issue QUIT")
+			break
 		}
+		if req.err == nil {
+			req.err = sess.rateLimit(proxy, req)
+		}
+		sess.dispatch(proxy, req)
+		// requests after AUTH are rate limited by the user it authenticates
+		if req.name == "AUTH" || req.name == "HELLO" {
+			<-req.done
+		}
+	}
 
-		begin_time := time.Now().UnixNano()
+	if !sess.closed {
+		close(sess.quit)
+	}
+	// pumps may still push messages until subscriptions are closed
+	sess.execs.Wait()
+	sess.sub.close()
+	sess.tx.drop()
+	close(sess.pending)
+	<-writeDone
+	sess.close(err)
+	if sess.closed {
+		return nil
+	}
+	return err
+}
 
-		rlt, err := sess.exec(proxy, req_obj)
-		if sess.closed {
-			sess.close(err)
-			return nil
+// writeLoop write replies in order, flush only when no more reply is ready to write
+func (sess *session) writeLoop() {
+	for req := range sess.pending {
+		<-req.done
+		if req.err != nil {
+			sess.cliConn.write([]byte("-" + req.err.Error() + "\r\n"))
+		} else if req.stream != nil {
+			sess.writeStream(req.stream)
+		} else {
+			sess.cliConn.write(req.resp)
 		}
+		atomic.AddInt64(&sess.unreplied, -1)
+		if len(sess.pending) == 0 {
+			sess.cliConn.flush()
+		}
+	}
+	sess.cliConn.flush()
+}
+
+// writeStream write chunks of a reply as they're read from the node, the client
+// is disconnected if the reply is broken halfway
+func (sess *session) writeStream(stream *replyStream) {
+	for {
+		chunk, err := stream.next()
 		if err != nil {
-			sess.cliConn.writeBytes([]byte("-" + err.Error() + "\r\n"))
-		} else {
-			sess.cliConn.writeBytes(rlt)
+			log.Println("reply broken:", sess.remoteAddr(), err)
+			sess.cliConn.close()
+			return
 		}
+		if chunk == nil {
+			return
+		}
+		sess.cliConn.write(chunk)
+		sess.cliConn.flush()
+	}
+}
 
+// dispatch queue the request for reply and execute it once requests it depends on are done
+func (sess *session) dispatch(proxy Proxy, req *request) {
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+	if req.cmd != nil {
+		sess.lastCmd.Store(req.name)
+	}
+	deps := sess.depends(req)
+	barrier := sess.barrier == req
+	atomic.AddInt64(&sess.unreplied, 1)
+	sess.pending <- req
+	sess.execs.Add(1)
+	go func() {
+		defer sess.execs.Done()
+		// a request of the same slot goes through the same connection, it only
+		// waits until the requests before it are queued there
+		for _, dep := range deps {
+			if barrier {
+				<-dep.done
+			} else {
+				<-dep.queued
+			}
+		}
+		begin_time := time.Now().UnixNano()
+		req.resp, req.err = sess.exec(proxy, req)
 		end_time := time.Now().UnixNano()
-		sess.ops += 1
-		sess.microsecond += uint64((end_time - begin_time) / (1000))
+		atomic.AddUint64(&sess.ops, 1)
+		atomic.AddUint64(&sess.microsecond, uint64((end_time-begin_time)/(1000)))
+		if req.cmd != nil {
+			recordCommand(req.name, uint64((end_time-begin_time)/1000), req.err != nil)
+		} else {
+			recordCommand("", 0, true)
+		}
+		req.markQueued()
+		close(req.done)
+	}()
+}
+
+// markQueued tell requests waiting for req that it's queued to the node
+func (req *request) markQueued() {
+	req.queueOnce.Do(func() {
+		close(req.queued)
+	})
+}
+
+// depends return in-flight requests that must be queued before req is executed,
+// or done if req is a barrier
+func (sess *session) depends(req *request) []*request {
+	deps := make([]*request, 0, 2)
+	if sess.barrier != nil {
+		deps = append(deps, sess.barrier)
+	}
+	if req.unordered {
+		if len(sess.unordered) >= PIPELINESIZE {
+			running := sess.unordered[:0]
+			for _, r := range sess.unordered {
+				select {
+				case <-r.done:
+				default:
+					running = append(running, r)
+				}
+			}
+			sess.unordered = running
+		}
+		sess.unordered = append(sess.unordered, req)
+		return deps
+	}
+	if req.slot < 0 && len(req.slots) == 0 {
+		for slot, r := range sess.inflight {
+			deps = append(deps, r)
+			delete(sess.inflight, slot)
+		}
+		deps = append(deps, sess.unordered...)
+		sess.unordered = nil
+		sess.barrier = req
+		return deps
+	}
+
+	if len(sess.inflight) >= PIPELINESIZE {
+		for slot, r := range sess.inflight {
+			select {
+			case <-r.done:
+				delete(sess.inflight, slot)
+			default:
+			}
+		}
 	}
+	slots := req.slots
+	if len(slots) == 0 {
+		slots = []uint16{uint16(req.slot)}
+	}
+	for _, slot := range slots {
+		if r, ok := sess.inflight[slot]; ok {
+			deps = append(deps, r)
+		}
+		sess.inflight[slot] = req
+	}
+	return deps
 }
 
-func (sess *session) readReq() (interface{}, error) {
-	sess.cliConn.clear()
-	return sess.cliConn.readReply()
+func (sess *session) readReq(proxy Proxy) (*request, error) {
+	// AUTH and HELLO are done before the next request is read
+	user, _ := sess.user.Load().(*aclUser)
+	raw, args, err := sess.cliConn.readRequest(user == nil && proxy.getACL().required())
+	if err != nil {
+		return nil, err
+	}
+	req := &request{
+		raw:    raw,
+		slot:   -1,
+		done:   make(chan struct{}),
+		queued: make(chan struct{}),
+	}
+
+	if len(args) == 0 {
+		req.err = protocolError("bad request length")
+		return req, nil
+	}
+	for _, arg := range args {
+		if arg == nil {
+			req.err = protocolError("bad argument type")
+			return req, nil
+		}
+	}
+	req.args = args
+	req.name = strings.ToUpper(strings.TrimSpace(string(req.args[0])))
+	req.args = req.args[1:]
+
+	req.cmd = lookupCommand(req.name)
+	if req.cmd == nil {
+		return req, nil
+	}
+	req.keys = req.cmd.keys(req.args)
+	// pub/sub commands change subscriber mode, transaction commands and commands
+	// queued by MULTI change transaction state, they are executed in order. Like
+	// redis, requests after a blocking command wait until it returns
+	ordered := req.cmd.flags&CmdPubsub != 0 || txCmds[req.name] || sess.queueing || req.cmd.blocks(req.args)
+	switch req.name {
+	case "MULTI":
+		sess.queueing = true
+	case "EXEC", "DISCARD":
+		sess.queueing = false
+	}
+	switch {
+	case ordered:
+	case unorderedCmds[req.name]:
+		req.unordered = true
+	case multiKeyCmds[req.name]:
+		req.slot, req.slots = multiKeySlots(req.keys)
+	default:
+		req.slot = keysSlot(req.keys)
+	}
+	return req, nil
+}
+
+// unorderedCmds are keyless read-only commands, they run without waiting for
+// requests before them, and requests after them don't wait for them
+var unorderedCmds = map[string]bool{
+	"PING":      true,
+	"INFO":      true,
+	"TIME":      true,
+	"DBSIZE":    true,
+	"KEYS":      true,
+	"RANDOMKEY": true,
+	"SCAN":      true,
+}
+
+// multiKeySlots return the slot of keys if they hash to a single slot, or all
+// slots of keys
+func multiKeySlots(keys [][]byte) (int, []uint16) {
+	if slot := keysSlot(keys); slot >= 0 || len(keys) == 0 {
+		return slot, nil
+	}
+	seen := make(map[uint16]bool)
+	slots := make([]uint16, 0, len(keys))
+	for _, key := range keys {
+		slot := KeySlot(key)
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return -1, slots
 }
 
-func (sess *session) exec(proxy Proxy, req_obj interface{}) ([]byte, error) {
-	req_body, ok := req_obj.([]interface{})
-	if !ok || len(req_body) == 0 {
-		return nil, protocolError("bad request length")
+func (sess *session) exec(proxy Proxy, req *request) ([]byte, error) {
+	req_cmd := req.name
+	if req.err != nil {
+		// a bad or rate limited request after MULTI makes EXEC abort
+		if sess.tx.multi && !txCmds[req_cmd] {
+			sess.tx.dirty = true
+		}
+		return nil, req.err
+	}
+
+	if err := sess.checkAccess(proxy, req); err != nil {
+		// like other rejected commands, EXEC will abort
+		if sess.tx.multi && !txCmds[req_cmd] {
+			sess.tx.dirty = true
+		}
+		return nil, err
+	}
+
+	// commands after MULTI are checked and queued until EXEC
+	if sess.tx.multi && !txCmds[req_cmd] {
+		return sess.tx.queue(req)
 	}
-	req_cmd := string(req_body[0].([]uint8))
 
-	// handle unsupported command
+	// handle unknown and unsupported command
 	switch {
-	case UnsupportedCmd(strings.ToUpper(strings.TrimSpace(req_cmd))):
+	case req.cmd == nil:
+		return nil, protocolError("unknown command '" + req_cmd + "'")
+	case req.cmd.flags&CmdDeny != 0:
 		return nil, protocolError("unsupported cmd " + req_cmd)
-	case strings.ToUpper(req_cmd) == "QUIT":
-		sess.closed = true
-		return nil, protocolError("client issue QUIT")
-	case strings.ToUpper(req_cmd) == "PING":
+	case !req.cmd.checkArity(len(req.args) + 1):
+		return nil, protocolError("wrong number of arguments for '" + strings.ToLower(req_cmd) + "' command")
+	// RESP3 clients can run any command in subscriber mode
+	case sess.sub.active() && sess.proto == RESP2 && !allowedInSubscribe[req_cmd]:
+		return nil, redisError("ERR Can't execute '" + strings.ToLower(req_cmd) +
+			"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+	case txCmds[req_cmd]:
+		return sess.txDo(proxy, req)
+	case req_cmd == "PING" && sess.sub.active() && sess.proto == RESP2:
+		return subscribePing(req.args), nil
+	case req_cmd == "PING":
 		return []byte("+PONG\r\n"), nil
+	case req_cmd == "READONLY":
+		sess.readMaster = false
+		return encodeReply(okReply), nil
+	case req_cmd == "READWRITE":
+		sess.readMaster = true
+		return encodeReply(okReply), nil
+	case req_cmd == "CLIENT":
+		return sess.clientDo(proxy, req.args)
+	case req_cmd == "AUTH":
+		return sess.authDo(proxy, req.args)
+	case req_cmd == "HELLO":
+		return sess.helloDo(proxy, req.args)
 	}
 
-	if len(req_body) < 2 {
-		return nil, protocolError("only one argument given " + req_cmd)
+	if req.cmd.flags&CmdPubsub != 0 {
+		return sess.pubsubDo(proxy, req)
 	}
-	req_key, ok := req_body[1].([]uint8)
-	if !ok {
-		return nil, protocolError("bad key type")
+
+	readReplica := req.cmd.flags&CmdReadonly != 0 && !sess.readMaster
+
+	// keys of a multi-key command may hash to different slots
+	if multiKeyCmds[req_cmd] {
+		return proxy.multiKeyDo(req_cmd, req.args, readReplica, req.markQueued)
+	}
+	if fanoutCmds[req_cmd] {
+		return proxy.fanoutDo(req_cmd, req.args)
+	}
+
+	switch req_cmd {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO":
+		return proxy.evalDo(req_cmd, req.args, req.keys, readReplica, sess.proto)
+	case "SCRIPT":
+		return proxy.scriptDo(req.args)
+	case "SCAN":
+		return proxy.scanDo(req.args)
 	}
 
-	req_slot := KeySlot([]byte(req_key))
-	req_bytes := sess.cliConn.getResponse()
-	return proxy.slotDo(req_bytes, req_slot)
+	if req.cmd.blocks(req.args) {
+		slot := keysSlot(req.keys)
+		switch {
+		case len(req.keys) == 0:
+			return nil, protocolError("no key found in cmd " + req_cmd)
+		case slot < 0:
+			return nil, protocolError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+		return proxy.blockingDo(req.raw, uint16(slot), req.cmd.blockTimeout(req.args), sess.quit, sess.proto)
+	}
+
+	switch {
+	case len(req.keys) == 0:
+		return nil, protocolError("no key found in cmd " + req_cmd)
+	case req.slot < 0:
+		return nil, protocolError("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	fw := &forwarding{stream: newReplyStream(), queued: req.markQueued}
+	resp, err := proxy.streamDo(req.raw, uint16(req.slot), readReplica, sess.proto, fw)
+	if err == nil && fw.stream.started() {
+		req.stream = fw.stream
+	}
+	return resp, err
 }
 
 func (sess *session) close(err error) {
@@ -104,9 +485,9 @@ func (sess *session) close(err error) {
 		", closed at:",
 		time.Now().Format(time.Stamp),
 		", ops:",
-		sess.ops,
+		atomic.LoadUint64(&sess.ops),
 		", microseconds:",
-		sess.microsecond,
+		atomic.LoadUint64(&sess.microsecond),
 		", remote:",
 		sess.remoteAddr())
 }
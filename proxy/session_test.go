@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipelineProxy hold forwarded requests until release is closed, started
+// receives a request once it's queued
+type pipelineProxy struct {
+	Proxy
+	acl     *acl
+	started chan string
+	release chan struct{}
+}
+
+func (p *pipelineProxy) getACL() *acl {
+	return p.acl
+}
+
+func (p *pipelineProxy) getRateLimiter() *rateLimiter {
+	return nil
+}
+
+func (p *pipelineProxy) streamDo(cmd []byte, id uint16, read bool, proto int, fw *forwarding) ([]byte, error) {
+	fw.queued()
+	p.started <- string(cmd)
+	<-p.release
+	return []byte("+OK\r\n"), nil
+}
+
+func (p *pipelineProxy) multiKeyDo(cmd string, args [][]byte, readReplica bool, queued func()) ([]byte, error) {
+	queued()
+	p.started <- cmd
+	<-p.release
+	return []byte("+OK\r\n"), nil
+}
+
+func (p *pipelineProxy) fanoutDo(cmd string, args [][]byte) ([]byte, error) {
+	p.started <- cmd
+	<-p.release
+	return []byte("+OK\r\n"), nil
+}
+
+func TestSessionPipeline(t *testing.T) {
+	tests := []struct {
+		cmds []string
+		// number of requests in flight together
+		inflight int
+	}{
+		{[]string{"GET a", "SET a 1", "GET a"}, 3},
+		{[]string{"SET a 1", "GET b", "GET a"}, 3},
+		{[]string{"MGET a b", "GET a", "DEL b c"}, 3},
+		{[]string{"GET a", "INFO", "DBSIZE", "GET a"}, 4},
+		// requests after a barrier wait until it's done
+		{[]string{"GET a", "READWRITE", "GET a"}, 1},
+	}
+	acl, err := newACL(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		p := &pipelineProxy{acl: acl, started: make(chan string, len(test.cmds)), release: make(chan struct{})}
+		client, server := net.Pipe()
+		go func() {
+			for _, cmd := range test.cmds {
+				fields := strings.Fields(cmd)
+				args := make([][]byte, 0, len(fields))
+				for _, f := range fields {
+					args = append(args, []byte(f))
+				}
+				server.Write(encodeCmd(args))
+			}
+		}()
+		sess := NewSession(client).(*session)
+		for range test.cmds {
+			req, err := sess.readReq(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sess.dispatch(p, req)
+		}
+
+		inflight := 0
+		timeout := time.After(100 * time.Millisecond)
+	wait:
+		for inflight < len(test.cmds) {
+			select {
+			case <-p.started:
+				inflight++
+			case <-timeout:
+				break wait
+			}
+		}
+		if inflight != test.inflight {
+			t.Errorf("%q: %d requests in flight, want %d", test.cmds, inflight, test.inflight)
+		}
+		close(p.release)
+		sess.execs.Wait()
+		client.Close()
+		server.Close()
+	}
+}
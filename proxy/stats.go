@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// startTime is when the proxy process started
+var startTime = time.Now()
+
+// commandStat counts calls of a command, usec is the total latency in microsecond
+type commandStat struct {
+	calls  uint64
+	usec   uint64
+	failed uint64
+}
+
+var (
+	// command name => *commandStat
+	commandStats sync.Map
+	totalOps     uint64
+	// live sessions by id
+	sessions      = make(map[uint64]*session)
+	sessionLock   sync.Mutex
+	lastSessionID uint64
+	totalSessions uint64
+)
+
+// recordCommand count a request executed by a session
+func recordCommand(name string, usec uint64, failed bool) {
+	atomic.AddUint64(&totalOps, 1)
+	commandDuration.observe(time.Duration(usec) * time.Microsecond)
+	if name == "" {
+		return
+	}
+	v, ok := commandStats.Load(name)
+	if !ok {
+		v, _ = commandStats.LoadOrStore(name, &commandStat{})
+	}
+	stat := v.(*commandStat)
+	atomic.AddUint64(&stat.calls, 1)
+	atomic.AddUint64(&stat.usec, usec)
+	if failed {
+		atomic.AddUint64(&stat.failed, 1)
+	}
+}
+
+func registerSession(sess *session) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	lastSessionID++
+	totalSessions++
+	sess.id = lastSessionID
+	sessions[sess.id] = sess
+}
+
+func unregisterSession(sess *session) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	delete(sessions, sess.id)
+}
+
+// liveSessions return live sessions ordered by id
+func liveSessions() []*session {
+	sessionLock.Lock()
+	list := make([]*session, 0, len(sessions))
+	for _, sess := range sessions {
+		list = append(list, sess)
+	}
+	sessionLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// usage return the pool size, established connections and requests queued or
+// waiting for reply
+func (b *backend) usage() (size int, established int, pending int) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	size = len(b.conns)
+	for _, pc := range b.conns {
+		if pc != nil {
+			established++
+			pending += len(pc.reqs) + len(pc.inflight)
+		}
+	}
+	return size, established, pending
+}
+
+// proxyInfo build proxy sections of INFO, they are about the proxy itself
+// instead of cluster nodes
+func (p *proxy) proxyInfo() []byte {
+	var buf bytes.Buffer
+	line := func(key string, value interface{}) {
+		switch v := value.(type) {
+		case string:
+			buf.WriteString(key + ":" + v + "\r\n")
+		case int:
+			buf.WriteString(key + ":" + strconv.Itoa(v) + "\r\n")
+		case uint64:
+			buf.WriteString(key + ":" + strconv.FormatUint(v, 10) + "\r\n")
+		}
+	}
+
+	sessionLock.Lock()
+	clients, received := len(sessions), totalSessions
+	sessionLock.Unlock()
+
+	buf.WriteString("# Proxy\r\n")
+	line("uptime_in_seconds", int(time.Since(startTime).Seconds()))
+	line("listen", p.config().Listen)
+	line("read_policy", p.config().ReadPolicy)
+	line("connected_clients", clients)
+	line("total_connections_received", received)
+	line("total_commands_processed", atomic.LoadUint64(&totalOps))
+	line("moved_redirections", atomic.LoadUint64(&p.movedCount))
+	line("ask_redirections", atomic.LoadUint64(&p.askCount))
+	line("slot_map_version", atomic.LoadUint64(&p.slotVersion))
+	line("cluster_masters", len(p.masters()))
+	buf.WriteString("\r\n")
+
+	buf.WriteString("# ProxyBackends\r\n")
+	p.backendLock.Lock()
+	addrs := make([]string, 0, len(p.backend))
+	for addr := range p.backend {
+		addrs = append(addrs, addr)
+	}
+	p.backendLock.Unlock()
+	sort.Strings(addrs)
+	for i, addr := range addrs {
+		b := p.getBackend(addr)
+		size, established, pending := b.usage()
+		healthy := "0"
+		if b.healthy() {
+			healthy = "1"
+		}
+		fields := []string{
+			"addr=" + addr,
+			"pool_size=" + strconv.Itoa(size),
+			"connections=" + strconv.Itoa(established),
+			"pending=" + strconv.Itoa(pending),
+			"healthy=" + healthy,
+		}
+		// latency is unknown until the node is pinged
+		if latency := b.getLatency(); latency < time.Hour {
+			fields = append(fields, "latency_usec="+strconv.FormatInt(int64(latency/time.Microsecond), 10))
+		}
+		line("backend"+strconv.Itoa(i), strings.Join(fields, ","))
+	}
+	buf.WriteString("\r\n")
+
+	buf.WriteString("# ProxyCommandstats\r\n")
+	names := make([]string, 0)
+	commandStats.Range(func(k, v interface{}) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		v, _ := commandStats.Load(name)
+		stat := v.(*commandStat)
+		calls := atomic.LoadUint64(&stat.calls)
+		usec := atomic.LoadUint64(&stat.usec)
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		line("cmdstat_"+strings.ToLower(name), "calls="+strconv.FormatUint(calls, 10)+
+			",usec="+strconv.FormatUint(usec, 10)+
+			",usec_per_call="+strconv.FormatFloat(perCall, 'f', 2, 64)+
+			",failed_calls="+strconv.FormatUint(atomic.LoadUint64(&stat.failed), 10))
+	}
+	return buf.Bytes()
+}
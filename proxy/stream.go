@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"strconv"
+	"sync"
+)
+
+// bulk strings of at least STREAMSIZE bytes are forwarded from nodes to clients
+// in chunks of STREAMCHUNK bytes
+const (
+	STREAMSIZE  = 256 * 1024
+	STREAMCHUNK = 64 * 1024
+)
+
+// replyStream is a long bulk string forwarded to the client while it's read from
+// a node, chunks are released once written. Chunks are queued instead of blocking
+// the reader, so a client not reading never holds up the connection to the node
+// shared with other sessions
+type replyStream struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	begun  bool
+	done   bool
+	err    error
+}
+
+func newReplyStream() *replyStream {
+	s := &replyStream{}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// push queue a chunk, the first one is the head line of the reply
+func (s *replyStream) push(chunk []byte) {
+	s.lock.Lock()
+	s.chunks = append(s.chunks, chunk)
+	s.begun = true
+	s.lock.Unlock()
+	s.cond.Signal()
+}
+
+// finish end the stream, err is set if the reply is broken
+func (s *replyStream) finish(err error) {
+	s.lock.Lock()
+	s.done = true
+	s.err = err
+	s.lock.Unlock()
+	s.cond.Signal()
+}
+
+// started tell if the reply goes through the stream
+func (s *replyStream) started() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.begun
+}
+
+// next wait for the next chunk, it's nil at the end of the reply
+func (s *replyStream) next() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.chunks) == 0 && !s.done {
+		s.cond.Wait()
+	}
+	if len(s.chunks) == 0 {
+		return nil, s.err
+	}
+	chunk := s.chunks[0]
+	s.chunks[0] = nil
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+// readStream read the reply of req from pc, a long bulk string is streamed through
+// req.stream and req is done once its head is read. It returns false if the
+// reply is streamed
+func (pc *pipeConn) readStream(req *backendReq) ([]byte, bool, error) {
+	head, left, err := pc.conn.readRawHead(STREAMSIZE)
+	if left == 0 {
+		return head, true, err
+	}
+	req.stream.push(head)
+	close(req.done)
+	// the payload in chunks, then its terminator
+	for left -= 2; left > 0; {
+		size := left
+		if size > STREAMCHUNK {
+			size = STREAMCHUNK
+		}
+		chunk := make([]byte, size)
+		if err := pc.conn.readChunk(chunk); err != nil {
+			pc.breakStream(req, err)
+			return nil, false, nil
+		}
+		req.stream.push(chunk)
+		left -= size
+	}
+	crlf := make([]byte, 2)
+	if err := pc.conn.readChunk(crlf); err != nil {
+		pc.breakStream(req, err)
+		return nil, false, nil
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		pc.breakStream(req, protocolError("bad bulk string format"))
+		return nil, false, nil
+	}
+	req.stream.push(crlf)
+	req.stream.finish(nil)
+	return nil, false, nil
+}
+
+// breakStream fail pc and the reply streamed from it, the rest of the reply is lost
+func (pc *pipeConn) breakStream(req *backendReq, err error) {
+	req.stream.finish(err)
+	pc.fail(err.Error())
+}
+
+// forwarding is a client request sent to a node as it is
+type forwarding struct {
+	// long bulk string replies are streamed through it if it's set
+	stream *replyStream
+	// called once the request is queued on the connection of its slot, requests
+	// of the slot queued after it are executed after it. It may be nil
+	queued func()
+}
+
+// streamDo send cmd of slot `id` like slotDo, or like readSlotDo if read is set,
+// a long bulk string reply is streamed through fw.stream
+func (p *proxy) streamDo(cmd []byte, id uint16, read bool, proto int, fw *forwarding) ([]byte, error) {
+	if id >= SLOTSIZE {
+		return nil, protocolError("slot id out of range: " + strconv.Itoa(int(id)))
+	}
+	master := p.nodeAddr(id)
+	addr := master
+	if read {
+		addr = p.readAddr(id)
+	}
+	// requests after it go to the master, they're not ordered with a replica
+	if addr != master && fw != nil {
+		fw = &forwarding{stream: fw.stream}
+	}
+	return p.slotDoAt(cmd, id, addr, proto, fw)
+}
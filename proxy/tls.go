@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+)
+
+// TLSConfig of client listener or connections to nodes, files are in PEM format.
+// For the listener, ca verifies client certificates and enables mutual TLS.
+// For nodes, ca verifies node certificates, cert and key are sent to nodes
+// with tls-auth-clients enabled
+type TLSConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Cert    string `toml:"cert"`
+	Key     string `toml:"key"`
+	CA      string `toml:"ca"`
+	// name to verify node certificates with, the host of node address if empty
+	ServerName string `toml:"server_name"`
+	// don't verify node certificates, for testing only
+	SkipVerify bool `toml:"skip_verify"`
+}
+
+// serverConfig build tls config of the client listener
+func (t *TLSConfig) serverConfig() (*tls.Config, error) {
+	if t.Cert == "" || t.Key == "" {
+		return nil, protocolError("config: tls needs cert and key")
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CA != "" {
+		if conf.ClientCAs, err = loadCertPool(t.CA); err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// clientConfig build tls config of connections to nodes
+func (t *TLSConfig) clientConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.SkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if t.CA != "" {
+		var err error
+		if conf.RootCAs, err = loadCertPool(t.CA); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, protocolError("no certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// Listen listen on conf.Listen for clients, with TLS if it's enabled. The listener
+// is inherited from the parent process on hot restart
+func Listen(conf *Config) (net.Listener, error) {
+	ln, err := listenTCP(conf.Listen)
+	if err != nil || !conf.TLS.Enabled {
+		return ln, err
+	}
+	tlsConf, err := conf.TLS.serverConfig()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	tcp, _ := ln.(*net.TCPListener)
+	return &tlsListener{Listener: tls.NewListener(ln, tlsConf), tcp: tcp}, nil
+}
@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parseToml parse the subset of TOML used by proxy config: [table], [[array of tables]],
+// and `key = value` where value is a string, integer, float, boolean or an array of them
+func parseToml(data string) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	cur := root
+
+	lines := strings.Split(data, "\n")
+	for lineno := 0; lineno < len(lines); lineno++ {
+		line := strings.TrimSpace(stripComment(lines[lineno]))
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, tomlError(lineno, "bad array of tables")
+			}
+			parent, name, err := tomlTable(root, strings.TrimSpace(line[2:len(line)-2]))
+			if err != nil {
+				return nil, tomlError(lineno, err.Error())
+			}
+			arr, _ := parent[name].([]map[string]interface{})
+			if _, ok := parent[name]; ok && arr == nil {
+				return nil, tomlError(lineno, name+" is not an array of tables")
+			}
+			cur = make(map[string]interface{})
+			parent[name] = append(arr, cur)
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, tomlError(lineno, "bad table")
+			}
+			parent, name, err := tomlTable(root, strings.TrimSpace(line[1:len(line)-1]))
+			if err != nil {
+				return nil, tomlError(lineno, err.Error())
+			}
+			if _, ok := parent[name]; ok {
+				return nil, tomlError(lineno, "table "+name+" defined twice")
+			}
+			cur = make(map[string]interface{})
+			parent[name] = cur
+		default:
+			eq := strings.Index(line, "=")
+			if eq <= 0 {
+				return nil, tomlError(lineno, "expect key = value")
+			}
+			key := strings.Trim(strings.TrimSpace(line[:eq]), "\"")
+			raw := strings.TrimSpace(line[eq+1:])
+			// arrays may span many lines
+			for strings.HasPrefix(raw, "[") && unclosed(raw) {
+				lineno++
+				if lineno >= len(lines) {
+					return nil, tomlError(lineno, "unterminated array")
+				}
+				raw += " " + strings.TrimSpace(stripComment(lines[lineno]))
+			}
+			val, err := tomlValue(raw)
+			if err != nil {
+				return nil, tomlError(lineno, err.Error())
+			}
+			if _, ok := cur[key]; ok {
+				return nil, tomlError(lineno, "key "+key+" defined twice")
+			}
+			cur[key] = val
+		}
+	}
+	return root, nil
+}
+
+func tomlError(lineno int, msg string) error {
+	return protocolError(fmt.Sprintf("config line %d: %s", lineno+1, msg))
+}
+
+// stripComment remove `# comment` which is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			// literal strings in single quotes have no escapes
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unclosed tell if raw has more `[` than `]` outside strings
+func unclosed(raw string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '[':
+			depth++
+		case quote == 0 && c == ']':
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+// tomlTable walk dotted table name from root, return the parent table and the last name
+func tomlTable(root map[string]interface{}, name string) (map[string]interface{}, string, error) {
+	parts := strings.Split(name, ".")
+	cur := root
+	for _, part := range parts[:len(parts)-1] {
+		switch next := cur[part].(type) {
+		case map[string]interface{}:
+			cur = next
+		case []map[string]interface{}:
+			cur = next[len(next)-1]
+		case nil:
+			m := make(map[string]interface{})
+			cur[part] = m
+			cur = m
+		default:
+			return nil, "", protocolError(part + " is not a table")
+		}
+	}
+	return cur, parts[len(parts)-1], nil
+}
+
+func tomlValue(raw string) (interface{}, error) {
+	switch {
+	case raw == "":
+		return nil, protocolError("missing value")
+	case raw == "true":
+		return true, nil
+	case raw == "false":
+		return false, nil
+	case raw[0] == '"':
+		return strconv.Unquote(raw)
+	case raw[0] == '\'':
+		if len(raw) < 2 || raw[len(raw)-1] != '\'' {
+			return nil, protocolError("bad string " + raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw[0] == '[':
+		if raw[len(raw)-1] != ']' {
+			return nil, protocolError("bad array " + raw)
+		}
+		arr := make([]interface{}, 0)
+		for _, item := range splitArray(raw[1 : len(raw)-1]) {
+			val, err := tomlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, val)
+		}
+		return arr, nil
+	}
+	num := strings.Replace(raw, "_", "", -1)
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	return nil, protocolError("bad value " + raw)
+}
+
+// splitArray split items of a one level array by comma outside strings
+func splitArray(s string) []string {
+	items := make([]string, 0)
+	var quote byte
+	begin := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			items = append(items, strings.TrimSpace(s[begin:i]))
+			begin = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[begin:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// decodeToml set fields of struct v by their `toml` tag
+func decodeToml(table map[string]interface{}, v reflect.Value) error {
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("toml"); tag != "" {
+			fields[tag] = v.Field(i)
+		}
+	}
+	for key, val := range table {
+		field, ok := fields[key]
+		if !ok {
+			return protocolError("unknown config key " + key)
+		}
+		if err := setField(field, val); err != nil {
+			return protocolError("config key " + key + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, val interface{}) error {
+	switch field.Kind() {
+	case reflect.String:
+		s, ok := val.(string)
+		if !ok {
+			return protocolError("expect string")
+		}
+		field.SetString(s)
+	case reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return protocolError("expect boolean")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, ok := val.(int64)
+		if !ok {
+			return protocolError("expect integer")
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		switch n := val.(type) {
+		case float64:
+			field.SetFloat(n)
+		case int64:
+			field.SetFloat(float64(n))
+		default:
+			return protocolError("expect number")
+		}
+	case reflect.Struct:
+		table, ok := val.(map[string]interface{})
+		if !ok {
+			return protocolError("expect table")
+		}
+		return decodeToml(table, field)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Struct {
+			tables, ok := val.([]map[string]interface{})
+			if !ok {
+				return protocolError("expect array of tables")
+			}
+			slice := reflect.MakeSlice(field.Type(), len(tables), len(tables))
+			for i, table := range tables {
+				if err := decodeToml(table, slice.Index(i)); err != nil {
+					return err
+				}
+			}
+			field.Set(slice)
+			return nil
+		}
+		arr, ok := val.([]interface{})
+		if !ok {
+			return protocolError("expect array")
+		}
+		slice := reflect.MakeSlice(field.Type(), len(arr), len(arr))
+		for i, item := range arr {
+			if err := setField(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+	default:
+		return protocolError("unsupported field type " + field.Type().String())
+	}
+	return nil
+}
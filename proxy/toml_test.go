@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]interface{}
+	}{
+		{`a = "x"`, map[string]interface{}{"a": "x"}},
+		{`a = "x\ty\"z"`, map[string]interface{}{"a": "x\ty\"z"}},
+		{`a = 'C:\certs\'`, map[string]interface{}{"a": `C:\certs\`}},
+		{`a = 'say "hi"'`, map[string]interface{}{"a": `say "hi"`}},
+		{`a = "# not a comment" # comment`, map[string]interface{}{"a": "# not a comment"}},
+		{`a = '# not a comment\' # comment`, map[string]interface{}{"a": `# not a comment\`}},
+		{`a = 1_000`, map[string]interface{}{"a": int64(1000)}},
+		{`a = -5`, map[string]interface{}{"a": int64(-5)}},
+		{`a = 0.5`, map[string]interface{}{"a": 0.5}},
+		{`a = true`, map[string]interface{}{"a": true}},
+		{`a = []`, map[string]interface{}{"a": []interface{}{}}},
+		{`deny_commands = ["a", 'C:\certs\']`, map[string]interface{}{"deny_commands": []interface{}{"a", `C:\certs\`}}},
+		{`a = ["x,y", 'z\', "]"]`, map[string]interface{}{"a": []interface{}{"x,y", `z\`, "]"}}},
+		{"a = [\n  \"x\", # first\n  'y[',\n]", map[string]interface{}{"a": []interface{}{"x", "y["}}},
+		{"[t]\na = 1\n[t.u]\nb = 2", map[string]interface{}{"t": map[string]interface{}{"a": int64(1), "u": map[string]interface{}{"b": int64(2)}}}},
+		{"[[u]]\na = 1\n[[u]]\na = 2", map[string]interface{}{"u": []map[string]interface{}{{"a": int64(1)}, {"a": int64(2)}}}},
+	}
+	for _, test := range tests {
+		got, err := parseToml(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %#v, want %#v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{`a =`, "missing value"},
+		{`a = 'x`, "bad string"},
+		{`a = "x`, "invalid syntax"},
+		{`a = ["x"`, "unterminated array"},
+		{`a = ["x", y]`, "bad value"},
+		{"a = 1\na = 2", "line 2: key a defined twice"},
+		{"[t]\n[t]", "table t defined twice"},
+		{"[[t]\na = 1", "bad array of tables"},
+		{"[t\na = 1", "bad table"},
+		{"just text", "expect key = value"},
+	}
+	for _, test := range tests {
+		_, err := parseToml(test.in)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.in, err, test.err)
+		}
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	conf, err := LoadConfig("../proxy.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Seeds) != 2 {
+		t.Errorf("got seeds %q from the example", conf.Seeds)
+	}
+	if err := conf.Check(); err != nil {
+		t.Error(err)
+	}
+}
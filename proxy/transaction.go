@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// txCmds are commands handled by session transaction
+var txCmds = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"UNWATCH": true,
+}
+
+// transaction holds MULTI/EXEC state of a session. Commands after MULTI are queued
+// locally and sent together with EXEC over one dedicated connection, which is pinned
+// from the first WATCH to EXEC, so all keys of a transaction must be in one slot.
+// Transaction commands are executed in order, so the state needs no lock
+type transaction struct {
+	multi bool
+	// a command is rejected while queueing, EXEC will abort
+	dirty bool
+	// slot of keys watched or queued, -1 if no key yet
+	slot   int
+	queued [][]byte
+	// WATCH is issued, conn must not change until EXEC, DISCARD or UNWATCH
+	watching bool
+	conn     RedisConn
+	addr     string
+	// protocol of conn
+	proto int
+}
+
+func newTransaction() *transaction {
+	return &transaction{slot: -1}
+}
+
+// queue check and queue a command after MULTI
+func (tx *transaction) queue(req *request) ([]byte, error) {
+	var err error
+	switch {
+	case req.cmd == nil:
+		err = protocolError("unknown command '" + req.name + "'")
+	case req.cmd.flags&(CmdDeny|CmdPubsub) != 0 || req.name == "AUTH" || req.name == "HELLO":
+		err = protocolError("unsupported cmd " + req.name + " in transaction")
+	case fanoutCmds[req.name] || req.name == "SCAN":
+		// they run on all masters, the transaction runs on one node
+		err = protocolError("unsupported cmd " + req.name + " in transaction, it runs on all masters")
+	case !req.cmd.checkArity(len(req.args) + 1):
+		err = protocolError("wrong number of arguments for '" + strings.ToLower(req.name) + "' command")
+	}
+	if err == nil && len(req.keys) > 0 {
+		slot := keysSlot(req.keys)
+		if slot < 0 || (tx.slot >= 0 && slot != tx.slot) {
+			err = protocolError("CROSSSLOT Keys in transaction don't hash to the same slot")
+		} else {
+			tx.slot = slot
+		}
+	}
+	if err != nil {
+		tx.dirty = true
+		return nil, err
+	}
+	tx.queued = append(tx.queued, req.raw)
+	return []byte("+QUEUED\r\n"), nil
+}
+
+// txDo handle MULTI, EXEC, DISCARD, WATCH and UNWATCH
+func (sess *session) txDo(proxy Proxy, req *request) ([]byte, error) {
+	tx := sess.tx
+	switch req.name {
+	case "MULTI":
+		if tx.multi {
+			return nil, redisError("ERR MULTI calls can not be nested")
+		}
+		tx.multi = true
+		return encodeReply(okReply), nil
+	case "WATCH":
+		if tx.multi {
+			return nil, redisError("ERR WATCH inside MULTI is not allowed")
+		}
+		slot := keysSlot(req.keys)
+		if slot < 0 || (tx.slot >= 0 && slot != tx.slot) {
+			return nil, protocolError("CROSSSLOT Keys in transaction don't hash to the same slot")
+		}
+		conn, err := tx.pin(proxy, slot, sess.proto)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := tx.roundTrip(conn, req.raw, 0)
+		if err == nil {
+			tx.watching = true
+		}
+		return resp, err
+	case "UNWATCH":
+		if tx.multi {
+			// queued and executed by redis, it's a no-op inside MULTI anyway
+			return []byte("+QUEUED\r\n"), nil
+		}
+		return encodeReply(okReply), tx.reset()
+	case "DISCARD":
+		if !tx.multi {
+			return nil, redisError("ERR DISCARD without MULTI")
+		}
+		return encodeReply(okReply), tx.reset()
+	case "EXEC":
+		if !tx.multi {
+			return nil, redisError("ERR EXEC without MULTI")
+		}
+		if tx.dirty {
+			tx.reset()
+			return nil, redisError("EXECABORT Transaction discarded because of previous errors.")
+		}
+		return tx.exec(proxy, sess.proto)
+	}
+	return nil, protocolError("unsupported cmd " + req.name)
+}
+
+// exec send queued commands wrapped in MULTI and EXEC, return the reply of EXEC in proto
+func (tx *transaction) exec(proxy Proxy, proto int) ([]byte, error) {
+	defer tx.reset()
+	if len(tx.queued) == 0 && !tx.watching {
+		return []byte("*0\r\n"), nil
+	}
+	slot := tx.slot
+	if slot < 0 {
+		// no key in transaction, any node works
+		slot = 0
+	}
+	conn, err := tx.pin(proxy, slot, proto)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]byte, 0)
+	cmds = append(cmds, encodeCmd([][]byte{[]byte("MULTI")})...)
+	for _, cmd := range tx.queued {
+		cmds = append(cmds, cmd...)
+	}
+	cmds = append(cmds, encodeCmd([][]byte{[]byte("EXEC")})...)
+	// replies of MULTI and queued commands are +OK and +QUEUED, or errors which
+	// make EXEC abort, only the reply of EXEC goes to client
+	resp, err := tx.roundTrip(conn, cmds, len(tx.queued)+1)
+	// EXEC releases watched keys
+	tx.watching = false
+	return resp, err
+}
+
+// roundTrip write cmds and read replies, the first skip replies are dropped
+func (tx *transaction) roundTrip(conn RedisConn, cmds []byte, skip int) ([]byte, error) {
+	if err := conn.writeBytes(cmds); err != nil {
+		tx.drop()
+		return nil, err
+	}
+	var resp []byte
+	for i := 0; i <= skip; i++ {
+		var err error
+		if resp, err = conn.readRaw(); err != nil && !isReplyError(err) {
+			tx.drop()
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// pin return the connection of a transaction to slot speaking proto, the connection
+// is kept for next transactions to the same node
+func (tx *transaction) pin(proxy Proxy, slot int, proto int) (RedisConn, error) {
+	tx.slot = slot
+	if tx.watching {
+		return tx.conn, nil
+	}
+	addr := proxy.nodeAddr(uint16(slot))
+	if addr == "" {
+		return nil, clusterDownError("")
+	}
+	if tx.conn != nil && tx.addr == addr && tx.proto == proto {
+		return tx.conn, nil
+	}
+	tx.drop()
+	conn, err := proxy.dedicatedConn(addr, -1, proto)
+	if err != nil {
+		return nil, dialError(addr, err)
+	}
+	tx.conn, tx.addr, tx.proto = conn, addr, proto
+	return conn, nil
+}
+
+// reset state after EXEC, DISCARD or UNWATCH, watched keys are released
+func (tx *transaction) reset() error {
+	var err error
+	if tx.watching && tx.conn != nil {
+		_, err = tx.roundTrip(tx.conn, encodeCmd([][]byte{[]byte("UNWATCH")}), 0)
+	}
+	tx.multi = false
+	tx.dirty = false
+	tx.slot = -1
+	tx.queued = nil
+	tx.watching = false
+	return err
+}
+
+// drop close the connection, watched keys are released by redis
+func (tx *transaction) drop() {
+	if tx.conn != nil {
+		tx.conn.close()
+	}
+	tx.conn, tx.addr = nil, ""
+	tx.watching = false
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+// testRequest build a request like session.readReq
+func testRequest(line string) *request {
+	fields := strings.Fields(line)
+	args := make([][]byte, 0, len(fields))
+	for _, f := range fields {
+		args = append(args, []byte(f))
+	}
+	req := &request{
+		name: strings.ToUpper(fields[0]),
+		args: args[1:],
+		raw:  encodeCmd(args),
+		slot: -1,
+	}
+	if req.cmd = lookupCommand(req.name); req.cmd != nil {
+		req.keys = req.cmd.keys(req.args)
+	}
+	return req
+}
+
+func TestTransactionQueue(t *testing.T) {
+	tests := []struct {
+		cmd string
+		err string
+	}{
+		{"SET {a}1 v", ""},
+		{"MGET {a}1 {a}2", ""},
+		{"PING", ""},
+		{"FLUSHALL", "unsupported cmd FLUSHALL in transaction"},
+		{"FLUSHDB", "unsupported cmd FLUSHDB in transaction"},
+		{"INFO", "unsupported cmd INFO in transaction"},
+		{"DBSIZE", "unsupported cmd DBSIZE in transaction"},
+		{"KEYS *", "unsupported cmd KEYS in transaction"},
+		{"SCAN 0", "unsupported cmd SCAN in transaction"},
+		{"SUBSCRIBE c", "unsupported cmd SUBSCRIBE in transaction"},
+		{"AUTH pass", "unsupported cmd AUTH in transaction"},
+		{"GET", "wrong number of arguments"},
+		{"NOSUCHCMD", "unknown command"},
+		{"MGET {a}1 {b}1", "CROSSSLOT"},
+	}
+	for _, test := range tests {
+		tx := newTransaction()
+		resp, err := tx.queue(testRequest(test.cmd))
+		if test.err == "" {
+			if err != nil || string(resp) != "+QUEUED\r\n" {
+				t.Errorf("%s: got %q %v, want QUEUED", test.cmd, resp, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.cmd, err, test.err)
+		}
+		if !tx.dirty || len(tx.queued) != 0 {
+			t.Errorf("%s: rejected command doesn't abort the transaction", test.cmd)
+		}
+	}
+
+	// keys of all commands must be in one slot
+	tx := newTransaction()
+	tx.queue(testRequest("SET {a}1 v"))
+	if _, err := tx.queue(testRequest("SET {b}1 v")); err == nil || !strings.Contains(err.Error(), "CROSSSLOT") {
+		t.Errorf("got error %v, want CROSSSLOT", err)
+	}
+}